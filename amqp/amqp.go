@@ -5,9 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
-	"github.com/assembla/cony"
 	"github.com/facebookgo/muster"
 	"github.com/streadway/amqp"
 	"gopkg.in/tomb.v2"
@@ -22,54 +22,127 @@ type ReportStorage struct {
 	BatchTimeout         time.Duration
 	PendingWorkCapacity  uint
 	ExchangeName         string
-	RoutingKey           string
+	// ExchangeKind is a type of declared exchange: direct, fanout, topic or headers
+	ExchangeKind    string
+	ExchangeDurable bool
+	RoutingKey      string
+	Index           frontreport.IndexTemplate
+	// Persistent makes broker store published batches on disk, so that they survive its restart
+	Persistent bool
+	// ConfirmTimeout enables publisher confirms: a batch is published again if broker rejects it
+	// or does not confirm it in time
+	ConfirmTimeout time.Duration
+	// Mandatory makes broker return batches which are not routed to any queue, it requires publisher confirms
+	Mandatory            bool
+	MaxRetries           int
+	RetryBackoff         time.Duration
 	AMQPConnectionString string
-	Logger               frontreport.Logger
-	MetricStorage        frontreport.MetricStorage
-	publisher            *cony.Publisher
-	muster               muster.Client
-	tomb                 tomb.Tomb
-	metrics              struct {
+	// FailedReportStorage gets reports of batches which failed to publish after all retries instead of dropping them
+	FailedReportStorage frontreport.FailedReportStorage
+	Logger              frontreport.Logger
+	MetricStorage       frontreport.MetricStorage
+	mu                  sync.Mutex
+	dial                func() (connection, error)
+	connection          connection
+	connected           chan struct{}
+	canceled            chan struct{}
+	muster              muster.Client
+	tomb                tomb.Tomb
+	metrics             struct {
 		batchSizeBytes       frontreport.MetricHistogram
 		batchFireErrors      frontreport.MetricCounter
+		batchRetries         frontreport.MetricCounter
+		batchReturned        frontreport.MetricCounter
+		batchDropped         frontreport.MetricCounter
 		reportEncodingErrors frontreport.MetricCounter
+		queueFull            frontreport.MetricCounter
 	}
 }
 
+const maxReconnectDelay = 30 * time.Second
+
+// stopTimeout is how long Stop waits for pending batches to be published before canceling publishing
+var stopTimeout = 10 * time.Second
+
+var (
+	errCanceled       = errors.New("publishing canceled on stop")
+	errNacked         = errors.New("batch is rejected by AMQP broker")
+	errConfirmTimeout = errors.New("timed out waiting for AMQP broker to confirm batch")
+	errConfirmsClosed = errors.New("channel closed before AMQP broker confirmed batch")
+	errNotConnected   = errors.New("not connected to AMQP broker")
+)
+
+// item is an encoded report with its bulk action line
+type item struct {
+	report frontreport.Reportable
+	data   []byte
+}
+
+// connection is an AMQP connection, so that tests can fake a broker
+type connection interface {
+	Channel() (channel, error)
+	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// channel is an AMQP channel, so that tests can fake a broker
+type channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	Confirm(noWait bool) error
+	NotifyPublish(chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(chan amqp.Return) chan amqp.Return
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// brokerConnection is a connection to a real broker
+type brokerConnection struct {
+	*amqp.Connection
+}
+
+func (c brokerConnection) Channel() (channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// returnedError means that broker could not route a mandatory batch to any queue, publishing it again makes no sense
+type returnedError struct {
+	amqp.Return
+}
+
+func (err returnedError) Error() string {
+	return fmt.Sprintf("batch is returned by AMQP broker: %d %s", err.ReplyCode, err.ReplyText)
+}
+
 // Start initializes AMQP connections and muster batching
 func (rs *ReportStorage) Start() error {
 	rs.metrics.batchSizeBytes = rs.MetricStorage.RegisterHistogram("amqp.batch_size_bytes")
 	rs.metrics.batchFireErrors = rs.MetricStorage.RegisterCounter("amqp.batch_fire.errors")
+	rs.metrics.batchRetries = rs.MetricStorage.RegisterCounter("amqp.batch.retries")
+	rs.metrics.batchReturned = rs.MetricStorage.RegisterCounter("amqp.batch.returned")
+	rs.metrics.batchDropped = rs.MetricStorage.RegisterCounter("amqp.batch.dropped")
 	rs.metrics.reportEncodingErrors = rs.MetricStorage.RegisterCounter("amqp.report_encoding.errors")
+	rs.metrics.queueFull = rs.MetricStorage.RegisterCounter("amqp.queue.full")
 
-	client := cony.NewClient(
-		cony.URL(rs.AMQPConnectionString),
-		cony.Backoff(cony.DefaultBackoff),
-	)
-
-	exchange := cony.Exchange{
-		Name:    rs.ExchangeName,
-		Kind:    "direct",
-		Durable: true,
+	if rs.Mandatory && rs.ConfirmTimeout <= 0 {
+		return errors.New("mandatory publishing requires publisher confirms")
 	}
-	client.Declare([]cony.Declaration{
-		cony.DeclareExchange(exchange),
-	})
-
-	rs.publisher = cony.NewPublisher(rs.ExchangeName, rs.RoutingKey)
-	client.Publish(rs.publisher)
 
-	rs.tomb.Go(func() error {
-		for client.Loop() {
-			select {
-			case <-rs.tomb.Dying():
-				client.Close()
-			case err := <-client.Errors():
-				rs.Logger.Log("msg", "error communicating with remote server", "error", err)
+	if rs.dial == nil {
+		rs.dial = func() (connection, error) {
+			c, err := amqp.Dial(rs.AMQPConnectionString)
+			if err != nil {
+				return nil, err
 			}
+			return brokerConnection{c}, nil
 		}
-		return nil
-	})
+	}
+	rs.connected = make(chan struct{})
+	rs.canceled = make(chan struct{})
+	rs.tomb.Go(rs.connect)
 
 	rs.muster.MaxBatchSize = rs.MaxBatchSize
 	rs.muster.MaxConcurrentBatches = rs.MaxConcurrentBatches
@@ -81,15 +154,15 @@ func (rs *ReportStorage) Start() error {
 	return err
 }
 
-// Stop flushes and stops muster batching
+// Stop flushes and stops muster batching, then closes AMQP connection
 func (rs *ReportStorage) Stop() error {
 	rs.tomb.Go(func() error {
-		timer := time.NewTimer(10 * time.Second)
+		timer := time.NewTimer(stopTimeout)
 		select {
 		case <-rs.tomb.Dying():
 			return nil
 		case <-timer.C:
-			rs.publisher.Cancel()
+			close(rs.canceled)
 			return errors.New("at least one publishing timed out, had to cancel")
 		}
 	})
@@ -105,46 +178,288 @@ func (rs *ReportStorage) Stop() error {
 	return errTomb
 }
 
+// connect keeps a connection to broker with declared exchange, reconnecting with growing delay after failures
+func (rs *ReportStorage) connect() error {
+	delay := time.Second
+	for {
+		connection, err := rs.open()
+		if err != nil {
+			rs.Logger.Log("msg", "failed to connect to AMQP broker", "retry_in", delay, "error", err)
+			select {
+			case <-rs.tomb.Dying():
+				return nil
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		delay = time.Second
+
+		closed := connection.NotifyClose(make(chan *amqp.Error, 1))
+		rs.mu.Lock()
+		rs.connection = connection
+		close(rs.connected)
+		rs.mu.Unlock()
+
+		select {
+		case <-rs.tomb.Dying():
+			return connection.Close()
+		case err := <-closed:
+			rs.Logger.Log("msg", "error communicating with remote server", "error", err)
+		}
+
+		rs.mu.Lock()
+		rs.connection = nil
+		rs.connected = make(chan struct{})
+		rs.mu.Unlock()
+	}
+}
+
+// open connects to broker and declares exchange
+func (rs *ReportStorage) open() (connection, error) {
+	connection, err := rs.dial()
+	if err != nil {
+		return nil, err
+	}
+	channel, err := connection.Channel()
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	defer channel.Close()
+	if err := channel.ExchangeDeclare(rs.ExchangeName, rs.ExchangeKind, rs.ExchangeDurable, false, false, false, nil); err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return connection, nil
+}
+
+// waitConnection blocks until broker is connected, so that batches pile up while it is unavailable
+func (rs *ReportStorage) waitConnection() (connection, error) {
+	for {
+		rs.mu.Lock()
+		connection, connected := rs.connection, rs.connected
+		rs.mu.Unlock()
+		if connection != nil {
+			return connection, nil
+		}
+		select {
+		case <-connected:
+		case <-rs.canceled:
+			return nil, errCanceled
+		}
+	}
+}
+
+// publish sends a batch over a separate channel once broker is connected
+func (rs *ReportStorage) publish(body []byte) error {
+	connection, err := rs.waitConnection()
+	if err != nil {
+		return err
+	}
+	return rs.publishTo(connection, body)
+}
+
+// publishTo sends a batch over a separate channel of a connection and waits for broker to confirm it
+// if publisher confirms are enabled
+func (rs *ReportStorage) publishTo(connection connection, body []byte) error {
+	channel, err := connection.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	var confirms chan amqp.Confirmation
+	var returns chan amqp.Return
+	if rs.ConfirmTimeout > 0 {
+		if err := channel.Confirm(false); err != nil {
+			return err
+		}
+		confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+	if rs.Mandatory {
+		returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+	}
+
+	deliveryMode := amqp.Transient
+	if rs.Persistent {
+		deliveryMode = amqp.Persistent
+	}
+	err = channel.Publish(rs.ExchangeName, rs.RoutingKey, rs.Mandatory, false, amqp.Publishing{
+		DeliveryMode: deliveryMode,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	if err != nil || confirms == nil {
+		return err
+	}
+	return awaitConfirmation(confirms, returns, rs.ConfirmTimeout, rs.canceled)
+}
+
+// awaitConfirmation waits for confirmation of a single published message unless waiting is canceled,
+// broker sends a return of an unroutable mandatory message before its confirmation
+func awaitConfirmation(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return, timeout time.Duration, canceled <-chan struct{}) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var returned *amqp.Return
+	for {
+		select {
+		case r := <-returns:
+			returned = &r
+		case confirmation, ok := <-confirms:
+			if !ok {
+				return errConfirmsClosed
+			}
+			if !confirmation.Ack {
+				return errNacked
+			}
+			if returned == nil {
+				select {
+				case r := <-returns:
+					returned = &r
+				default:
+				}
+			}
+			if returned != nil {
+				return returnedError{*returned}
+			}
+			return nil
+		case <-timer.C:
+			return errConfirmTimeout
+		case <-canceled:
+			return errCanceled
+		}
+	}
+}
+
 // AddReport adds a report of any type to next batch
 func (rs *ReportStorage) AddReport(report frontreport.Reportable) {
-	var indexName string
-	if report.GetService() != "" {
-		indexName = fmt.Sprintf("%s-report-%s-%s", report.GetType(), report.GetService(), time.Now().UTC().Format("2006.01.02"))
-	} else {
-		indexName = fmt.Sprintf("%s-report-%s", report.GetType(), time.Now().UTC().Format("2006.01.02"))
+	if it, ok := rs.newItem(report); ok {
+		rs.muster.Work <- it
+	}
+}
+
+// TryAddReport is AddReport which returns false instead of blocking when pending work capacity is exhausted,
+// e.g. while AMQP broker is unavailable
+func (rs *ReportStorage) TryAddReport(report frontreport.Reportable) bool {
+	it, ok := rs.newItem(report)
+	if !ok {
+		return true
+	}
+	select {
+	case rs.muster.Work <- it:
+		return true
+	default:
+		rs.metrics.queueFull.Inc(1)
+		return false
+	}
+}
+
+// SendReports publishes reports as one batch without retries, unless broker is not connected at the moment,
+// and returns them all if the batch is worth publishing again; a batch returned by broker is only counted
+func (rs *ReportStorage) SendReports(reports []frontreport.Reportable) ([]frontreport.Reportable, error) {
+	var body bytes.Buffer
+	var encoded []frontreport.Reportable
+	for _, report := range reports {
+		if it, ok := rs.newItem(report); ok {
+			body.Write(it.data)
+			encoded = append(encoded, report)
+		}
+	}
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+
+	rs.mu.Lock()
+	connection := rs.connection
+	rs.mu.Unlock()
+	if connection == nil {
+		return encoded, errNotConnected
+	}
+
+	rs.metrics.batchSizeBytes.Update(int64(body.Len()))
+	err := rs.publishTo(connection, body.Bytes())
+	if err == nil {
+		return nil, nil
+	}
+	rs.metrics.batchFireErrors.Inc(1)
+	if _, ok := err.(returnedError); ok {
+		rs.Logger.Log("msg", "failed to publish reports", "size", len(encoded), "error", err)
+		rs.metrics.batchReturned.Inc(1)
+		return nil, nil
 	}
+	return encoded, err
+}
 
+// newItem encodes a report with its bulk action line, it returns false if the report can't be encoded
+func (rs *ReportStorage) newItem(report frontreport.Reportable) (item, bool) {
 	decoratedReport := bytes.NewBufferString(
-		fmt.Sprintf("{\"index\": {\"_index\": \"%s\", \"_type\": \"%s-report\"}}\n", indexName, report.GetType()))
+		fmt.Sprintf("{\"index\": {\"_index\": \"%s\", \"_type\": \"%s-report\"}}\n", rs.Index.Name(report, frontreport.ReceivedAt(report)), report.GetType()))
 	encoder := json.NewEncoder(decoratedReport)
 	if err := encoder.Encode(&report); err != nil {
 		rs.Logger.Log("msg", "failed to encode", "report_type", report.GetType(), "error", err)
 		rs.metrics.reportEncodingErrors.Inc(1)
-	} else {
-		rs.muster.Work <- decoratedReport.Bytes()
+		return item{}, false
 	}
+	return item{report: report, data: decoratedReport.Bytes()}, true
 }
 
 type batch struct {
 	ReportStorage *ReportStorage
 	Items         bytes.Buffer
+	Reports       []frontreport.Reportable
 }
 
-func (b *batch) Add(item interface{}) {
-	b.Items.Write(item.([]byte))
+func (b *batch) Add(i interface{}) {
+	it := i.(item)
+	b.Items.Write(it.data)
+	b.Reports = append(b.Reports, it.report)
 }
 
+// Fire publishes a batch, publishing it again with exponential backoff if it fails until publishing is canceled on stop,
+// reports of a batch which failed to publish are passed to FailedReportStorage if there is one
 func (b *batch) Fire(notifier muster.Notifier) {
 	defer notifier.Done()
-	err := b.ReportStorage.publisher.Publish(
-		amqp.Publishing{
-			DeliveryMode: amqp.Transient,
-			Timestamp:    time.Now(),
-			Body:         b.Items.Bytes(),
-		})
-	if err != nil {
-		b.ReportStorage.Logger.Log("msg", "failed to fire batch", "size", b.Items.Len(), "error", err)
-		b.ReportStorage.metrics.batchFireErrors.Inc(1)
+	rs := b.ReportStorage
+	rs.metrics.batchSizeBytes.Update(int64(b.Items.Len()))
+
+	backoff := rs.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := rs.publish(b.Items.Bytes())
+		if err == nil {
+			return
+		}
+		rs.Logger.Log("msg", "failed to fire batch", "size", b.Items.Len(), "attempt", attempt+1, "error", err)
+		rs.metrics.batchFireErrors.Inc(1)
+		if _, ok := err.(returnedError); ok {
+			rs.metrics.batchReturned.Inc(1)
+			return
+		}
+		if attempt >= rs.MaxRetries || err == errCanceled {
+			rs.Logger.Log("msg", "giving up publishing batch", "size", b.Items.Len())
+			b.fail()
+			return
+		}
+		select {
+		case <-rs.canceled:
+			rs.Logger.Log("msg", "giving up publishing batch on stop", "size", b.Items.Len())
+			b.fail()
+			return
+		case <-time.After(backoff):
+		}
+		rs.metrics.batchRetries.Inc(1)
+		backoff *= 2
+	}
+}
+
+// fail passes reports of a batch to FailedReportStorage if there is one, otherwise the batch is dropped
+func (b *batch) fail() {
+	rs := b.ReportStorage
+	if rs.FailedReportStorage != nil {
+		rs.FailedReportStorage.AddFailedReports(b.Reports)
+		return
 	}
-	b.ReportStorage.metrics.batchSizeBytes.Update(int64(b.Items.Len()))
+	rs.metrics.batchDropped.Inc(1)
 }
@@ -0,0 +1,331 @@
+package amqp
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/streadway/amqp"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// TestAwaitConfirmation tests how broker confirmations and returns of a published batch are interpreted
+func TestAwaitConfirmation(t *testing.T) {
+	Convey("Given a published batch", t, func() {
+		confirms := make(chan amqp.Confirmation, 1)
+		returns := make(chan amqp.Return, 1)
+
+		Convey("Acknowledged batch is published", func() {
+			confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+			So(awaitConfirmation(confirms, returns, time.Second, nil), ShouldBeNil)
+		})
+
+		Convey("Rejected batch is to be published again", func() {
+			confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: false}
+			So(awaitConfirmation(confirms, returns, time.Second, nil), ShouldEqual, errNacked)
+		})
+
+		Convey("Returned batch is reported even though it is acknowledged", func() {
+			returns <- amqp.Return{ReplyCode: 312, ReplyText: "NO_ROUTE"}
+			confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+			err := awaitConfirmation(confirms, returns, time.Second, nil)
+			So(err, ShouldHaveSameTypeAs, returnedError{})
+			So(err.Error(), ShouldContainSubstring, "NO_ROUTE")
+		})
+
+		Convey("Batch without confirmation times out", func() {
+			So(awaitConfirmation(confirms, returns, 10*time.Millisecond, nil), ShouldEqual, errConfirmTimeout)
+		})
+
+		Convey("Batch is not confirmed if channel is closed", func() {
+			close(confirms)
+			So(awaitConfirmation(confirms, nil, time.Second, nil), ShouldEqual, errConfirmsClosed)
+		})
+
+		Convey("Waiting for confirmation is canceled", func() {
+			canceled := make(chan struct{})
+			close(canceled)
+			So(awaitConfirmation(confirms, returns, time.Hour, canceled), ShouldEqual, errCanceled)
+		})
+	})
+}
+
+// fakeBroker fails first dials, nacks first published batches, returns them if mandatory when returning is set
+// and does not confirm them at all when silent is set
+type fakeBroker struct {
+	mu           sync.Mutex
+	dialFailures int
+	dials        int
+	nacks        int
+	returning    bool
+	silent       bool
+	published    []string
+	closed       chan *amqp.Error
+}
+
+func (fb *fakeBroker) dial() (connection, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.dials++
+	if fb.dialFailures > 0 {
+		fb.dialFailures--
+		return nil, errors.New("connection refused")
+	}
+	return fakeConnection{fb}, nil
+}
+
+// disconnect closes the last connection as if broker went down
+func (fb *fakeBroker) disconnect() {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.closed <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "broker is restarted"}
+}
+
+func (fb *fakeBroker) state() (int, []string) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.dials, append([]string(nil), fb.published...)
+}
+
+type fakeConnection struct {
+	broker *fakeBroker
+}
+
+func (fc fakeConnection) Channel() (channel, error) {
+	return &fakeChannel{broker: fc.broker}, nil
+}
+
+func (fc fakeConnection) NotifyClose(closed chan *amqp.Error) chan *amqp.Error {
+	fc.broker.mu.Lock()
+	defer fc.broker.mu.Unlock()
+	fc.broker.closed = closed
+	return closed
+}
+
+func (fc fakeConnection) Close() error {
+	return nil
+}
+
+type fakeChannel struct {
+	broker   *fakeBroker
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+func (fc *fakeChannel) ExchangeDeclare(string, string, bool, bool, bool, bool, amqp.Table) error {
+	return nil
+}
+
+func (fc *fakeChannel) Confirm(bool) error {
+	return nil
+}
+
+func (fc *fakeChannel) NotifyPublish(confirms chan amqp.Confirmation) chan amqp.Confirmation {
+	fc.confirms = confirms
+	return confirms
+}
+
+func (fc *fakeChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	fc.returns = returns
+	return returns
+}
+
+func (fc *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	fb := fc.broker
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.published = append(fb.published, string(msg.Body))
+	if fb.silent {
+		return nil
+	}
+	if mandatory && fb.returning {
+		fc.returns <- amqp.Return{ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	}
+	ack := fb.nacks == 0
+	if !ack {
+		fb.nacks--
+	}
+	fc.confirms <- amqp.Confirmation{DeliveryTag: uint64(len(fb.published)), Ack: ack}
+	return nil
+}
+
+func (fc *fakeChannel) Close() error {
+	return nil
+}
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 300; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func connected(rs *ReportStorage) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.connection != nil
+}
+
+// TestReportStorage tests that batches are published again after broker failures and publishing is canceled on stop
+func TestReportStorage(t *testing.T) {
+	Convey("Given AMQP storage with publisher confirms", t, func() {
+		broker := &fakeBroker{}
+		metricStorage := frontreporttest.NewMetricStorage()
+		rs := &ReportStorage{
+			MaxBatchSize:         10,
+			MaxConcurrentBatches: 1,
+			BatchTimeout:         10 * time.Millisecond,
+			PendingWorkCapacity:  10,
+			ExchangeName:         "frontreport",
+			Index:                frontreport.IndexTemplate{Template: "{type}-report"},
+			ConfirmTimeout:       time.Second,
+			MaxRetries:           2,
+			RetryBackoff:         time.Millisecond,
+			Logger:               log.NewNopLogger(),
+			MetricStorage:        metricStorage,
+			dial:                 broker.dial,
+		}
+		report := &frontreport.StacktraceJSReport{Message: "a"}
+
+		Convey("Batches are published after broker reconnects", func() {
+			broker.dialFailures = 1
+			So(rs.Start(), ShouldBeNil)
+			rs.AddReport(report)
+			So(waitFor(func() bool { _, published := broker.state(); return len(published) == 1 }), ShouldBeTrue)
+
+			broker.disconnect()
+			So(waitFor(func() bool { dials, _ := broker.state(); return dials == 3 }), ShouldBeTrue)
+			rs.AddReport(report)
+			So(rs.Stop(), ShouldBeNil)
+
+			_, published := broker.state()
+			So(published, ShouldHaveLength, 2)
+			So(published[0], ShouldContainSubstring, `"_index": "stacktracejs-report"`)
+		})
+
+		Convey("Rejected batch is published again", func() {
+			broker.nacks = 1
+			So(rs.Start(), ShouldBeNil)
+			rs.AddReport(report)
+			So(rs.Stop(), ShouldBeNil)
+
+			_, published := broker.state()
+			So(published, ShouldHaveLength, 2)
+			So(metricStorage.Count("amqp.batch.retries"), ShouldEqual, 1)
+			So(metricStorage.Count("amqp.batch.dropped"), ShouldEqual, 0)
+		})
+
+		Convey("Batch rejected more than retries allow is dropped", func() {
+			broker.nacks = 5
+			So(rs.Start(), ShouldBeNil)
+			rs.AddReport(report)
+			So(rs.Stop(), ShouldBeNil)
+
+			_, published := broker.state()
+			So(published, ShouldHaveLength, 3)
+			So(metricStorage.Count("amqp.batch.dropped"), ShouldEqual, 1)
+		})
+
+		Convey("Reports of a batch rejected more than retries allow are passed to failed report storage", func() {
+			failedStorage := &frontreporttest.MemoryStorage{}
+			rs.FailedReportStorage = failedStorage
+			broker.nacks = 5
+			So(rs.Start(), ShouldBeNil)
+			rs.AddReport(report)
+			So(rs.Stop(), ShouldBeNil)
+
+			So(failedStorage.Reports(), ShouldResemble, []frontreport.Reportable{report})
+			So(metricStorage.Count("amqp.batch.dropped"), ShouldEqual, 0)
+		})
+
+		Convey("Sending reports at once returns them if they are worth publishing again", func() {
+			other := &frontreport.CSPReport{}
+			broker.dialFailures = 1
+			So(rs.Start(), ShouldBeNil)
+			retry, err := rs.SendReports([]frontreport.Reportable{report, other})
+			So(err, ShouldNotBeNil)
+			So(retry, ShouldResemble, []frontreport.Reportable{report, other})
+			So(waitFor(func() bool { dials, _ := broker.state(); return dials == 2 }), ShouldBeTrue)
+			So(waitFor(func() bool { return connected(rs) }), ShouldBeTrue)
+
+			broker.mu.Lock()
+			broker.nacks = 1
+			broker.mu.Unlock()
+			retry, err = rs.SendReports([]frontreport.Reportable{report, other})
+			So(err, ShouldEqual, errNacked)
+			So(retry, ShouldResemble, []frontreport.Reportable{report, other})
+
+			retry, err = rs.SendReports([]frontreport.Reportable{report, other})
+			So(err, ShouldBeNil)
+			So(retry, ShouldBeEmpty)
+			So(rs.Stop(), ShouldBeNil)
+
+			_, published := broker.state()
+			So(published, ShouldHaveLength, 2)
+			So(published[1], ShouldContainSubstring, `"_index": "stacktracejs-report"`)
+			So(published[1], ShouldContainSubstring, `"_index": "csp-report"`)
+			So(metricStorage.Count("amqp.batch.retries"), ShouldEqual, 0)
+		})
+
+		Convey("Returned batch is not published again", func() {
+			rs.Mandatory = true
+			broker.returning = true
+			So(rs.Start(), ShouldBeNil)
+			rs.AddReport(report)
+			So(rs.Stop(), ShouldBeNil)
+
+			_, published := broker.state()
+			So(published, ShouldHaveLength, 1)
+			So(metricStorage.Count("amqp.batch.returned"), ShouldEqual, 1)
+			So(metricStorage.Count("amqp.batch.retries"), ShouldEqual, 0)
+		})
+
+		Convey("Returned batch sent at once is not to be published again", func() {
+			rs.Mandatory = true
+			broker.returning = true
+			So(rs.Start(), ShouldBeNil)
+			So(waitFor(func() bool { return connected(rs) }), ShouldBeTrue)
+			retry, err := rs.SendReports([]frontreport.Reportable{report})
+			So(err, ShouldBeNil)
+			So(retry, ShouldBeEmpty)
+			So(rs.Stop(), ShouldBeNil)
+			So(metricStorage.Count("amqp.batch.returned"), ShouldEqual, 1)
+		})
+
+		Convey("Stop cancels waiting for confirmation and retry backoff", func() {
+			defer func(timeout time.Duration) { stopTimeout = timeout }(stopTimeout)
+			stopTimeout = 50 * time.Millisecond
+
+			Convey("when broker does not confirm a batch", func() {
+				broker.silent = true
+				rs.ConfirmTimeout = time.Hour
+			})
+			Convey("when publishing is backed off", func() {
+				broker.nacks = 1
+				rs.RetryBackoff = time.Hour
+			})
+
+			So(rs.Start(), ShouldBeNil)
+			rs.AddReport(report)
+			So(waitFor(func() bool { _, published := broker.state(); return len(published) == 1 }), ShouldBeTrue)
+
+			stopped := make(chan error)
+			go func() { stopped <- rs.Stop() }()
+			select {
+			case err := <-stopped:
+				So(err, ShouldNotBeNil)
+			case <-time.After(5 * time.Second):
+				t.Fatal("stop is not canceled")
+			}
+			So(metricStorage.Count("amqp.batch.dropped"), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jessevdk/go-flags"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/amqp"
+	"github.com/skbkontur/frontreport/elasticsearch"
+	"github.com/skbkontur/frontreport/fanout"
+	"github.com/skbkontur/frontreport/hercules"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+	"github.com/skbkontur/frontreport/kafka"
+	"github.com/skbkontur/frontreport/routing"
+	"github.com/skbkontur/frontreport/spool"
+)
+
+// fakeServer counts requests by URL path and answers bulk requests as if every document is indexed
+type fakeServer struct {
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (fs *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.requests[r.URL.Path]++
+	if r.URL.Path == "/_bulk" {
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}
+}
+
+// count tells how many requests have URL path with a prefix
+func (fs *fakeServer) count(prefix string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var count int
+	for path, requests := range fs.requests {
+		if strings.HasPrefix(path, prefix) {
+			count += requests
+		}
+	}
+	return count
+}
+
+// TestNewStorage tests that every --storage value makes its backends wrapped as configured
+func TestNewStorage(t *testing.T) {
+	Convey("Given storage options", t, func() {
+		logger = log.NewNopLogger()
+		metrics := frontreporttest.NewMetricStorage()
+		parse := func(args ...string) storageOptions {
+			var opts storageOptions
+			_, err := flags.ParseArgs(&opts, args)
+			So(err, ShouldBeNil)
+			return opts
+		}
+
+		Convey("Every backend is made by its name", func() {
+			for name, backend := range map[string]interface{}{
+				"hercules":      &hercules.ReportStorage{},
+				"amqp":          &amqp.ReportStorage{},
+				"kafka":         &kafka.ReportStorage{},
+				"elasticsearch": &elasticsearch.ReportStorage{},
+			} {
+				storage, services, err := newStorage(parse("--storage", name), metrics)
+				So(err, ShouldBeNil)
+				So(storage, ShouldHaveSameTypeAs, backend)
+				So(services, ShouldHaveLength, 1)
+			}
+		})
+
+		Convey("Several backends get every report through fan-out storage", func() {
+			fakeHercules := &fakeServer{requests: make(map[string]int)}
+			herculesServer := httptest.NewServer(fakeHercules)
+			defer herculesServer.Close()
+			fakeElasticsearch := &fakeServer{requests: make(map[string]int)}
+			elasticsearchServer := httptest.NewServer(fakeElasticsearch)
+			defer elasticsearchServer.Close()
+
+			storage, services, err := newStorage(parse(
+				"--storage", "hercules, elasticsearch",
+				"--hercules-endpoint", herculesServer.URL,
+				"--elasticsearch-url", elasticsearchServer.URL,
+			), metrics)
+			So(err, ShouldBeNil)
+			So(storage, ShouldHaveSameTypeAs, &fanout.ReportStorage{})
+			So(services, ShouldHaveLength, 3)
+			So(services[2], ShouldEqual, storage)
+			children := storage.(*fanout.ReportStorage).Children
+			So(children, ShouldHaveLength, 2)
+			So(children[0].Name, ShouldEqual, "hercules")
+			So(children[1].Name, ShouldEqual, "elasticsearch")
+
+			for _, service := range services {
+				So(service.Start(), ShouldBeNil)
+			}
+			report := &frontreport.StacktraceJSReport{Message: "a"}
+			report.Service = "billing"
+			storage.AddReport(report)
+			for i := len(services) - 1; i >= 0; i-- {
+				So(services[i].Stop(), ShouldBeNil)
+			}
+			So(fakeHercules.count("/logs/stacktracejs-report-billing-"), ShouldEqual, 1)
+			So(fakeElasticsearch.count("/_bulk"), ShouldEqual, 1)
+		})
+
+		Convey("Reports are routed to backends if there are storage routes", func() {
+			storage, services, err := newStorage(parse(
+				"--storage", "hercules,kafka",
+				"--storage-route", "type=csp storage=kafka",
+			), metrics)
+			So(err, ShouldBeNil)
+			So(storage, ShouldHaveSameTypeAs, &routing.ReportStorage{})
+			So(services, ShouldHaveLength, 3)
+			So(storage.(*routing.ReportStorage).Storages, ShouldHaveLength, 2)
+			So(storage.(*routing.ReportStorage).DefaultStorage, ShouldEqual, "hercules")
+		})
+
+		Convey("Backends are spooled if spool directory is set", func() {
+			dir, err := ioutil.TempDir("", "spool")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			storage, services, err := newStorage(parse("--storage", "hercules,amqp,kafka,elasticsearch", "--spool-dir", dir), metrics)
+			So(err, ShouldBeNil)
+			children := storage.(*fanout.ReportStorage).Children
+			So(services, ShouldHaveLength, 5)
+			for _, child := range children {
+				So(child.ReportStorage, ShouldHaveSameTypeAs, &spool.ReportStorage{})
+				So(child.ReportStorage.(*spool.ReportStorage).Dir, ShouldEndWith, child.Name)
+			}
+			herculesSpool := children[0].ReportStorage.(*spool.ReportStorage)
+			So(herculesSpool.Backend.(*hercules.ReportStorage).FailedReportStorage, ShouldEqual, herculesSpool)
+			amqpSpool := children[1].ReportStorage.(*spool.ReportStorage)
+			So(amqpSpool.Backend.(*amqp.ReportStorage).FailedReportStorage, ShouldEqual, amqpSpool)
+			kafkaSpool := children[2].ReportStorage.(*spool.ReportStorage)
+			So(kafkaSpool.Backend.(*kafka.ReportStorage).FailedReportStorage, ShouldEqual, kafkaSpool)
+			elasticsearchSpool := children[3].ReportStorage.(*spool.ReportStorage)
+			So(elasticsearchSpool.Backend.(*elasticsearch.ReportStorage).FailedReportStorage, ShouldEqual, elasticsearchSpool)
+		})
+
+		Convey("Unknown and repeated backends are rejected", func() {
+			for _, value := range []string{"mongodb", "hercules,", "hercules,hercules", "elasticsearch, kafka ,elasticsearch"} {
+				_, _, err := newStorage(parse("--storage", value), metrics)
+				So(err, ShouldNotBeNil)
+			}
+			_, _, err := newStorage(parse("--storage", "hercules,hercules"), metrics)
+			So(err.Error(), ShouldContainSubstring, "more than once")
+		})
+	})
+}
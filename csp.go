@@ -0,0 +1,71 @@
+package frontreport
+
+import (
+	"net/url"
+	"strings"
+)
+
+// CSPNormalized holds CSP report fields that are the same in all browsers, so that reports can be aggregated on them
+type CSPNormalized struct {
+	Directive      string `json:"directive"`
+	BlockedOrigin  string `json:"blocked-origin,omitempty"`
+	BlockedScheme  string `json:"blocked-scheme,omitempty"`
+	DocumentOrigin string `json:"document-origin,omitempty"`
+	DocumentPath   string `json:"document-path,omitempty"`
+	Inline         bool   `json:"inline"`
+	Eval           bool   `json:"eval"`
+}
+
+// Normalize fills normalized fields from browser-specific report body:
+// directive is taken from effective-directive, or from violated-directive without sources in older browsers;
+// blocked-uri may be a full URL, an origin, a scheme or a keyword like inline and eval
+func (c *CSPReport) Normalize() {
+	directive := c.Body.EffectiveDirective
+	if directive == "" {
+		directive = strings.SplitN(strings.TrimSpace(c.Body.ViolatedDirective), " ", 2)[0]
+	}
+	c.Normalized.Directive = strings.ToLower(directive)
+
+	blockedURI := strings.TrimSpace(c.Body.BlockedURI)
+	switch strings.ToLower(blockedURI) {
+	case "inline":
+		c.Normalized.Inline = true
+	case "eval":
+		c.Normalized.Eval = true
+	case "":
+		// older browsers send empty blocked-uri for inline scripts and styles
+		c.Normalized.Inline = strings.HasPrefix(c.Normalized.Directive, "script-src") ||
+			strings.HasPrefix(c.Normalized.Directive, "style-src")
+	case "self":
+		c.Normalized.BlockedOrigin = uriOrigin(c.Body.DocumentURI)
+		c.Normalized.BlockedScheme = uriScheme(c.Body.DocumentURI)
+	default:
+		c.Normalized.BlockedOrigin = uriOrigin(blockedURI)
+		c.Normalized.BlockedScheme = uriScheme(blockedURI)
+	}
+
+	if u, err := url.Parse(c.Body.DocumentURI); err == nil {
+		c.Normalized.DocumentOrigin = uriOrigin(c.Body.DocumentURI)
+		c.Normalized.DocumentPath = u.Path
+	}
+}
+
+// uriScheme returns lowercase scheme of a URI, Chrome sends bare scheme like "data" as blocked-uri
+func uriScheme(uri string) string {
+	if i := strings.Index(uri, ":"); i > 0 {
+		return strings.ToLower(uri[:i])
+	}
+	if strings.ContainsAny(uri, "/.") {
+		return ""
+	}
+	return strings.ToLower(uri)
+}
+
+// uriOrigin returns scheme://host[:port] of a network URI
+func uriOrigin(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
@@ -0,0 +1,53 @@
+package frontreport
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// TestCSPReportNormalize tests that reports from different browsers get the same normalized fields
+func TestCSPReportNormalize(t *testing.T) {
+	Convey("Blocked URL", t, func() {
+		modern := &CSPReport{}
+		modern.Body.DocumentURI = "https://example.com/billing/pay?x=1"
+		modern.Body.BlockedURI = "https://CDN.evil.example:8443/lib.js?v=2"
+		modern.Body.EffectiveDirective = "script-src-elem"
+		modern.Normalize()
+
+		older := &CSPReport{}
+		older.Body.DocumentURI = "https://example.com/billing/pay"
+		older.Body.BlockedURI = "https://cdn.evil.example:8443"
+		older.Body.ViolatedDirective = "script-src-elem 'self' https://cdn.example.com"
+		older.Normalize()
+
+		So(older.Normalized, ShouldResemble, modern.Normalized)
+		So(modern.Normalized, ShouldResemble, CSPNormalized{
+			Directive:      "script-src-elem",
+			BlockedOrigin:  "https://cdn.evil.example:8443",
+			BlockedScheme:  "https",
+			DocumentOrigin: "https://example.com",
+			DocumentPath:   "/billing/pay",
+		})
+	})
+
+	Convey("Keywords and schemes", t, func() {
+		for blockedURI, expected := range map[string]CSPNormalized{
+			"inline":                     {Directive: "style-src", Inline: true},
+			"":                           {Directive: "style-src", Inline: true},
+			"eval":                       {Directive: "style-src", Eval: true},
+			"data":                       {Directive: "style-src", BlockedScheme: "data"},
+			"data:image/png;base64,AAAA": {Directive: "style-src", BlockedScheme: "data"},
+			"self":                       {Directive: "style-src", BlockedOrigin: "https://example.com", BlockedScheme: "https"},
+		} {
+			report := &CSPReport{}
+			report.Body.BlockedURI = blockedURI
+			report.Body.ViolatedDirective = "style-src"
+			report.Body.DocumentURI = "https://example.com"
+			report.Normalize()
+
+			expected.DocumentOrigin = "https://example.com"
+			So(report.Normalized, ShouldResemble, expected)
+		}
+	})
+}
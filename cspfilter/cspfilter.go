@@ -0,0 +1,208 @@
+package cspfilter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// Action tells what to do with a CSP report matching a rule
+type Action string
+
+// Reports matching a drop rule are not stored, reports matching a tag rule are stored with rule name in tags
+const (
+	ActionDrop Action = "drop"
+	ActionTag  Action = "tag"
+)
+
+// ruleNameRegexp matches characters which can't be a part of Graphite metric path
+var ruleNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// cspViolationFields maps csp-report fields of CSP Level 2 reports to body fields of CSP Level 3 reports
+var cspViolationFields = map[string]string{
+	"document-uri":        "documentURL",
+	"referrer":            "referrer",
+	"blocked-uri":         "blockedURL",
+	"violated-directive":  "effectiveDirective",
+	"effective-directive": "effectiveDirective",
+	"original-policy":     "originalPolicy",
+	"source-file":         "sourceFile",
+	"line-number":         "lineNumber",
+	"column-number":       "columnNumber",
+	"script-sample":       "sample",
+	"disposition":         "disposition",
+	"status-code":         "statusCode",
+}
+
+// Rule matches CSP reports with a csp-report field matching Pattern,
+// CSP Level 3 reports are matched by the same field of their body
+type Rule struct {
+	Name    string
+	Field   string
+	Pattern *regexp.Regexp
+	Action  Action
+}
+
+// BuiltinRules drop reports about resources injected by browser extensions
+// and about URIs browsers never load from network
+var BuiltinRules = []Rule{
+	{
+		Name:    "browser-extension",
+		Field:   "blocked-uri",
+		Pattern: regexp.MustCompile(`^(chrome|moz|safari|safari-web|ms-browser)-extension(:|$)`),
+		Action:  ActionDrop,
+	},
+	{
+		Name:    "non-network-scheme",
+		Field:   "blocked-uri",
+		Pattern: regexp.MustCompile(`^(about|data)(:|$)`),
+		Action:  ActionDrop,
+	},
+}
+
+// ParseRule parses rule as space-separated field=regexp, optional action=drop|tag and name=rule-name,
+// e.g. "blocked-uri=^https?://([a-z0-9-]+\.)*adnet\.example/ action=tag name=adware";
+// action defaults to drop and name defaults to rule_N where N is index of the rule,
+// characters of name not allowed in metric names are replaced with underscores
+func ParseRule(s string, index int) (Rule, error) {
+	rule := Rule{Name: fmt.Sprintf("rule_%d", index), Action: ActionDrop}
+	for _, part := range strings.Fields(s) {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return Rule{}, fmt.Errorf("invalid condition %q in CSP filter rule %q, must be field=regexp", part, s)
+		}
+		switch kv[0] {
+		case "action":
+			rule.Action = Action(kv[1])
+			if rule.Action != ActionDrop && rule.Action != ActionTag {
+				return Rule{}, fmt.Errorf("invalid action in CSP filter rule %q, must be drop or tag", s)
+			}
+		case "name":
+			rule.Name = ruleNameRegexp.ReplaceAllString(kv[1], "_")
+			if rule.Name == "" {
+				return Rule{}, fmt.Errorf("empty name in CSP filter rule %q", s)
+			}
+		default:
+			if rule.Pattern != nil {
+				return Rule{}, fmt.Errorf("more than one field in CSP filter rule %q", s)
+			}
+			pattern, err := regexp.Compile(kv[1])
+			if err != nil {
+				return Rule{}, fmt.Errorf("invalid regexp in CSP filter rule %q: %s", s, err)
+			}
+			rule.Field, rule.Pattern = kv[0], pattern
+		}
+	}
+	if rule.Pattern == nil {
+		return Rule{}, fmt.Errorf("no field in CSP filter rule %q", s)
+	}
+	return rule, nil
+}
+
+// ParseRules parses rules and appends them to given ones, e.g. BuiltinRules, rule names must be unique
+func ParseRules(ss []string, rules []Rule) ([]Rule, error) {
+	rules = append([]Rule(nil), rules...)
+	names := make(map[string]bool, len(rules)+len(ss))
+	for _, rule := range rules {
+		names[rule.Name] = true
+	}
+	for i, s := range ss {
+		rule, err := ParseRule(s, i)
+		if err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate name %s of CSP filter rule %q", rule.Name, s)
+		}
+		names[rule.Name] = true
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Match tells if report field matches rule pattern, reports other than CSP never match
+func (r Rule) Match(report frontreport.Reportable) bool {
+	var value string
+	var found bool
+	switch report := report.(type) {
+	case *frontreport.CSPReport:
+		value, found = frontreport.ReportField(report, "csp-report."+r.Field)
+	case *frontreport.CSPViolationReport:
+		if field, ok := cspViolationFields[r.Field]; ok {
+			value, found = frontreport.ReportField(report, "body."+field)
+		}
+	}
+	return found && r.Pattern.MatchString(value)
+}
+
+// ReportStorage drops or tags CSP Level 2 and Level 3 reports matching rules before passing them to the underlying ReportStorage,
+// reports of other types are passed as is
+type ReportStorage struct {
+	ReportStorage frontreport.ReportStorage
+	Rules         []Rule
+	Logger        frontreport.Logger
+	MetricStorage frontreport.MetricStorage
+	metrics       struct {
+		dropped frontreport.MetricCounter
+		tagged  frontreport.MetricCounter
+		hits    []frontreport.MetricCounter
+	}
+}
+
+// Start initializes metrics
+func (rs *ReportStorage) Start() error {
+	rs.metrics.dropped = rs.MetricStorage.RegisterCounter("csp_filter.dropped")
+	rs.metrics.tagged = rs.MetricStorage.RegisterCounter("csp_filter.tagged")
+	for _, rule := range rs.Rules {
+		rs.metrics.hits = append(rs.metrics.hits, rs.MetricStorage.RegisterCounter(fmt.Sprintf("csp_filter.rule.%s.hits", rule.Name)))
+	}
+	return nil
+}
+
+// Stop does nothing
+func (rs *ReportStorage) Stop() error {
+	return nil
+}
+
+// AddReport applies all rules to a CSP report, a report is dropped on the first drop rule it matches
+func (rs *ReportStorage) AddReport(report frontreport.Reportable) {
+	rs.addReport(report, true)
+}
+
+// TryAddReport is AddReport which returns false instead of blocking when the underlying storage is saturated,
+// dropped reports count as accepted
+func (rs *ReportStorage) TryAddReport(report frontreport.Reportable) bool {
+	return rs.addReport(report, false)
+}
+
+func (rs *ReportStorage) addReport(report frontreport.Reportable, block bool) bool {
+	var tags *[]string
+	switch report := report.(type) {
+	case *frontreport.CSPReport:
+		tags = &report.Tags
+	case *frontreport.CSPViolationReport:
+		tags = &report.Tags
+	default:
+		return frontreport.PassReport(rs.ReportStorage, report, block)
+	}
+
+	tagged := false
+	for i, rule := range rs.Rules {
+		if !rule.Match(report) {
+			continue
+		}
+		rs.metrics.hits[i].Inc(1)
+		if rule.Action == ActionDrop {
+			rs.metrics.dropped.Inc(1)
+			return true
+		}
+		*tags = append(*tags, rule.Name)
+		tagged = true
+	}
+	if tagged {
+		rs.metrics.tagged.Inc(1)
+	}
+	return frontreport.PassReport(rs.ReportStorage, report, block)
+}
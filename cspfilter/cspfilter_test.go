@@ -0,0 +1,83 @@
+package cspfilter
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+func cspReport(blockedURI string) *frontreport.CSPReport {
+	report := &frontreport.CSPReport{}
+	report.Body.BlockedURI = blockedURI
+	report.Body.ViolatedDirective = "script-src"
+	return report
+}
+
+// TestReportStorage tests that noise CSP reports are dropped or tagged
+func TestReportStorage(t *testing.T) {
+	Convey("Given CSP filter with builtin and user rules", t, func() {
+		adware, err := ParseRule(`blocked-uri=^https?://([a-z0-9-]+\.)*adnet\.example/ action=tag name=adware`, 0)
+		So(err, ShouldBeNil)
+		inline, err := ParseRule(`violated-directive=^style-src`, 1)
+		So(err, ShouldBeNil)
+		So(inline.Name, ShouldEqual, "rule_1")
+
+		next := &frontreporttest.MemoryStorage{}
+		metricStorage := frontreporttest.NewMetricStorage()
+		rs := &ReportStorage{
+			ReportStorage: next,
+			Rules:         append(append([]Rule{}, BuiltinRules...), adware, inline),
+			Logger:        log.NewNopLogger(),
+			MetricStorage: metricStorage,
+		}
+		So(rs.Start(), ShouldBeNil)
+
+		for _, blockedURI := range []string{"chrome-extension://abc/inject.js", "moz-extension", "about", "data:image/png;base64,xxx"} {
+			rs.AddReport(cspReport(blockedURI))
+		}
+		rs.AddReport(cspReport("https://cdn.adnet.example/banner.js"))
+		rs.AddReport(cspReport("https://evil.example/x.js"))
+		rs.AddReport(&frontreport.StacktraceJSReport{})
+
+		extension := &frontreport.CSPViolationReport{}
+		extension.Body.BlockedURL = "chrome-extension://abc/inject.js"
+		rs.AddReport(extension)
+		adnet := &frontreport.CSPViolationReport{}
+		adnet.Body.BlockedURL = "https://cdn.adnet.example/banner.js"
+		rs.AddReport(adnet)
+
+		So(next.Reports(), ShouldHaveLength, 4)
+		So(next.Reports()[0].(*frontreport.CSPReport).Tags, ShouldResemble, []string{"adware"})
+		So(next.Reports()[1].(*frontreport.CSPReport).Tags, ShouldBeEmpty)
+		So(next.Reports()[3].(*frontreport.CSPViolationReport).Tags, ShouldResemble, []string{"adware"})
+		So(metricStorage.Count("csp_filter.rule.browser-extension.hits"), ShouldEqual, 3)
+		So(metricStorage.Count("csp_filter.rule.adware.hits"), ShouldEqual, 2)
+	})
+
+	Convey("Rule names are fit for metric names and unique", t, func() {
+		rule, err := ParseRule("blocked-uri=x name=ad.ware", 0)
+		So(err, ShouldBeNil)
+		So(rule.Name, ShouldEqual, "ad_ware")
+
+		rules, err := ParseRules([]string{"blocked-uri=x name=ad.ware", "blocked-uri=y"}, BuiltinRules)
+		So(err, ShouldBeNil)
+		So(rules, ShouldHaveLength, len(BuiltinRules)+2)
+		So(rules[len(rules)-1].Name, ShouldEqual, "rule_1")
+
+		_, err = ParseRules([]string{"blocked-uri=x name=ad.ware", "blocked-uri=y name=ad_ware"}, nil)
+		So(err, ShouldNotBeNil)
+		_, err = ParseRules([]string{"blocked-uri=x name=browser-extension"}, BuiltinRules)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Invalid rules", t, func() {
+		for _, s := range []string{"action=tag", "blocked-uri=( action=drop", "blocked-uri=x action=log", "blocked-uri=x document-uri=y", "blocked-uri=x name="} {
+			_, err := ParseRule(s, 0)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
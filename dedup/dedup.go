@@ -0,0 +1,217 @@
+package dedup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// ReportStorage collapses reports with the same fingerprint received within Window into one report
+// carrying occurrence count, and passes it to the underlying ReportStorage;
+// reports without fingerprint are passed as is
+type ReportStorage struct {
+	ReportStorage frontreport.ReportStorage
+	Window        time.Duration
+	MaxGroups     int
+	MaxSamples    int
+	Logger        frontreport.Logger
+	MetricStorage frontreport.MetricStorage
+	mu            sync.Mutex
+	groups        map[string]*group
+	tomb          tomb.Tomb
+	metrics       struct {
+		received  frontreport.MetricCounter
+		collapsed frontreport.MetricCounter
+		flushed   frontreport.MetricCounter
+		overflow  frontreport.MetricCounter
+	}
+}
+
+// group is a pending report with occurrences of the same problem
+type group struct {
+	report  *Occurrences
+	expires time.Time
+	userIDs map[string]bool
+	urls    map[string]bool
+}
+
+// Occurrences is a report with frequency information, it is encoded as the report JSON with extra fields
+type Occurrences struct {
+	frontreport.Reportable
+	occurrenceFields
+}
+
+type occurrenceFields struct {
+	Count     int64    `json:"count"`
+	FirstSeen string   `json:"first_seen"`
+	LastSeen  string   `json:"last_seen"`
+	UserIDs   []string `json:"user_ids,omitempty"`
+	URLs      []string `json:"urls,omitempty"`
+}
+
+type userIDReport interface {
+	GetUserID() string
+}
+
+type urlReport interface {
+	GetURL() string
+}
+
+// GetHost returns host of the collapsed report, so that it is stored to the same index as the report itself
+func (o Occurrences) GetHost() string {
+	if hostReport, ok := o.Reportable.(frontreport.HostReport); ok {
+		return hostReport.GetHost()
+	}
+	return ""
+}
+
+// MarshalJSON merges occurrence fields into report JSON object
+func (o Occurrences) MarshalJSON() ([]byte, error) {
+	reportJSON, err := json.Marshal(o.Reportable)
+	if err != nil {
+		return nil, err
+	}
+	extraJSON, err := json.Marshal(o.occurrenceFields)
+	if err != nil {
+		return nil, err
+	}
+
+	reportJSON = bytes.TrimSpace(reportJSON)
+	if len(reportJSON) < 2 || reportJSON[0] != '{' {
+		return nil, fmt.Errorf("cannot add occurrences to %s report encoded as %s", o.GetType(), reportJSON)
+	}
+	buf := bytes.NewBuffer(reportJSON[:len(reportJSON)-1])
+	if len(bytes.TrimSpace(reportJSON[1:len(reportJSON)-1])) > 0 {
+		buf.WriteByte(',')
+	}
+	buf.Write(extraJSON[1:])
+	return buf.Bytes(), nil
+}
+
+// Start initializes metrics and starts flushing collapsed reports
+func (rs *ReportStorage) Start() error {
+	rs.metrics.received = rs.MetricStorage.RegisterCounter("dedup.reports.received")
+	rs.metrics.collapsed = rs.MetricStorage.RegisterCounter("dedup.reports.collapsed")
+	rs.metrics.flushed = rs.MetricStorage.RegisterCounter("dedup.reports.flushed")
+	rs.metrics.overflow = rs.MetricStorage.RegisterCounter("dedup.groups.overflow")
+
+	rs.groups = make(map[string]*group)
+
+	rs.tomb.Go(func() error {
+		ticker := time.NewTicker(rs.tickInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rs.tomb.Dying():
+				return nil
+			case now := <-ticker.C:
+				rs.flush(now)
+			}
+		}
+	})
+	return nil
+}
+
+// Stop flushes all pending reports regardless of their window
+func (rs *ReportStorage) Stop() error {
+	rs.tomb.Kill(nil)
+	err := rs.tomb.Wait()
+	if flushed := rs.flush(time.Time{}); flushed > 0 {
+		rs.Logger.Log("msg", "flushed pending collapsed reports", "count", flushed)
+	}
+	return err
+}
+
+// AddReport adds a report to the group of reports with the same fingerprint
+func (rs *ReportStorage) AddReport(report frontreport.Reportable) {
+	rs.addReport(report, true)
+}
+
+// TryAddReport is AddReport which returns false instead of blocking when a report passed as is
+// does not fit into the underlying storage; collapsed reports are always accepted
+func (rs *ReportStorage) TryAddReport(report frontreport.Reportable) bool {
+	return rs.addReport(report, false)
+}
+
+func (rs *ReportStorage) addReport(report frontreport.Reportable, block bool) bool {
+	rs.metrics.received.Inc(1)
+
+	fingerprintReport, ok := report.(frontreport.FingerprintReport)
+	if !ok || fingerprintReport.GetFingerprint() == "" {
+		return frontreport.PassReport(rs.ReportStorage, report, block)
+	}
+	key := report.GetType() + "/" + report.GetService() + "/" + fingerprintReport.GetFingerprint()
+	now := time.Now()
+	seen := now.UTC().Format(frontreport.TimestampFormat)
+
+	rs.mu.Lock()
+	g, found := rs.groups[key]
+	if !found {
+		if rs.MaxGroups > 0 && len(rs.groups) >= rs.MaxGroups {
+			rs.mu.Unlock()
+			rs.metrics.overflow.Inc(1)
+			return frontreport.PassReport(rs.ReportStorage, &Occurrences{report, occurrenceFields{Count: 1, FirstSeen: seen, LastSeen: seen}}, block)
+		}
+		g = &group{
+			report:  &Occurrences{report, occurrenceFields{FirstSeen: seen}},
+			expires: now.Add(rs.Window),
+			userIDs: make(map[string]bool),
+			urls:    make(map[string]bool),
+		}
+		rs.groups[key] = g
+	} else {
+		rs.metrics.collapsed.Inc(1)
+	}
+	g.add(report, seen, rs.MaxSamples)
+	rs.mu.Unlock()
+	return true
+}
+
+// add counts an occurrence and samples distinct user IDs and URLs
+func (g *group) add(report frontreport.Reportable, seen string, maxSamples int) {
+	g.report.Count++
+	g.report.LastSeen = seen
+	if r, ok := report.(userIDReport); ok && r.GetUserID() != "" && !g.userIDs[r.GetUserID()] && len(g.userIDs) < maxSamples {
+		g.userIDs[r.GetUserID()] = true
+		g.report.UserIDs = append(g.report.UserIDs, r.GetUserID())
+	}
+	if r, ok := report.(urlReport); ok && r.GetURL() != "" && !g.urls[r.GetURL()] && len(g.urls) < maxSamples {
+		g.urls[r.GetURL()] = true
+		g.report.URLs = append(g.report.URLs, r.GetURL())
+	}
+}
+
+// flush passes groups with window expired by now to the underlying storage, zero now flushes all groups;
+// it returns number of reports passed
+func (rs *ReportStorage) flush(now time.Time) int {
+	var expired []*Occurrences
+	rs.mu.Lock()
+	for key, g := range rs.groups {
+		if now.IsZero() || !now.Before(g.expires) {
+			expired = append(expired, g.report)
+			delete(rs.groups, key)
+		}
+	}
+	rs.mu.Unlock()
+
+	for _, report := range expired {
+		rs.metrics.flushed.Inc(1)
+		rs.ReportStorage.AddReport(report)
+	}
+	return len(expired)
+}
+
+// tickInterval makes reports wait for flush no longer than a tenth of the window after it expires
+func (rs *ReportStorage) tickInterval() time.Duration {
+	interval := rs.Window / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
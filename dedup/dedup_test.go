@@ -0,0 +1,90 @@
+package dedup
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+func stacktraceJSReport(fingerprint, userID, url string) *frontreport.StacktraceJSReport {
+	report := &frontreport.StacktraceJSReport{Message: "TypeError", Fingerprint: fingerprint, UserID: userID, URL: url}
+	report.Service = "billing"
+	return report
+}
+
+// TestReportStorage tests that reports of the same error are collapsed into one
+func TestReportStorage(t *testing.T) {
+	Convey("Given dedup storage", t, func() {
+		next := &frontreporttest.MemoryStorage{}
+		metricStorage := frontreporttest.NewMetricStorage()
+		rs := &ReportStorage{
+			ReportStorage: next,
+			Window:        time.Hour,
+			MaxGroups:     2,
+			MaxSamples:    2,
+			Logger:        log.NewNopLogger(),
+			MetricStorage: metricStorage,
+		}
+		So(rs.Start(), ShouldBeNil)
+
+		Convey("Reports with the same fingerprint are collapsed until window ends", func() {
+			rs.AddReport(stacktraceJSReport("a", "u1", "https://example.com/1"))
+			rs.AddReport(stacktraceJSReport("a", "u2", "https://example.com/1"))
+			rs.AddReport(stacktraceJSReport("a", "u3", "https://example.com/2"))
+			rs.AddReport(stacktraceJSReport("b", "u1", "https://example.com/1"))
+			So(next.Reports(), ShouldBeEmpty)
+
+			So(rs.Stop(), ShouldBeNil)
+			So(next.Reports(), ShouldHaveLength, 2)
+
+			var collapsed *Occurrences
+			for _, report := range next.Reports() {
+				if report.(*Occurrences).Reportable.(*frontreport.StacktraceJSReport).Fingerprint == "a" {
+					collapsed = report.(*Occurrences)
+				}
+			}
+			So(collapsed, ShouldNotBeNil)
+			So(collapsed.Count, ShouldEqual, 3)
+			So(collapsed.UserIDs, ShouldResemble, []string{"u1", "u2"})
+			So(collapsed.URLs, ShouldResemble, []string{"https://example.com/1", "https://example.com/2"})
+
+			var decoded map[string]interface{}
+			encoded, err := json.Marshal(collapsed)
+			So(err, ShouldBeNil)
+			So(json.Unmarshal(encoded, &decoded), ShouldBeNil)
+			So(decoded["message"], ShouldEqual, "TypeError")
+			So(decoded["service"], ShouldEqual, "billing")
+			So(decoded["count"], ShouldEqual, 3)
+			So(decoded["first_seen"], ShouldNotBeEmpty)
+			So(decoded["last_seen"], ShouldNotBeEmpty)
+		})
+
+		Convey("Reports without fingerprint and over groups limit are passed immediately", func() {
+			rs.AddReport(&frontreport.CSPReport{})
+			rs.AddReport(stacktraceJSReport("", "u1", ""))
+			rs.AddReport(stacktraceJSReport("a", "u1", ""))
+			rs.AddReport(stacktraceJSReport("b", "u1", ""))
+			rs.AddReport(stacktraceJSReport("c", "u1", ""))
+			So(next.Reports(), ShouldHaveLength, 3)
+			So(next.Reports()[2].(*Occurrences).Count, ShouldEqual, 1)
+
+			So(rs.Stop(), ShouldBeNil)
+			So(next.Reports(), ShouldHaveLength, 5)
+		})
+
+		Convey("Reports are flushed after window ends", func() {
+			rs.AddReport(stacktraceJSReport("a", "u1", ""))
+			rs.flush(time.Now().Add(time.Minute))
+			So(next.Reports(), ShouldBeEmpty)
+			rs.flush(time.Now().Add(time.Hour))
+			So(next.Reports(), ShouldHaveLength, 1)
+			So(rs.Stop(), ShouldBeNil)
+		})
+	})
+}
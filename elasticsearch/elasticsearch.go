@@ -0,0 +1,350 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/muster"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// ReportStorage is an Elasticsearch (or OpenSearch) bulk API implementation of frontreport.ReportStorage interface
+type ReportStorage struct {
+	URL      string
+	Username string
+	Password string
+	Index    frontreport.IndexTemplate
+	// DataStream makes reports appended with create operation, as data streams accept nothing else
+	DataStream bool
+	// TemplateName and TemplateFile configure an index template to put on start, e.g. with ILM policy or data stream settings
+	TemplateName         string
+	TemplateFile         string
+	MaxRetries           int
+	RetryBackoff         time.Duration
+	RequestTimeout       time.Duration
+	MaxBatchSize         uint
+	MaxConcurrentBatches uint
+	BatchTimeout         time.Duration
+	PendingWorkCapacity  uint
+	// FailedReportStorage gets reports which failed to index after all retries instead of dropping them
+	FailedReportStorage frontreport.FailedReportStorage
+	Logger              frontreport.Logger
+	MetricStorage       frontreport.MetricStorage
+	client              *http.Client
+	muster              muster.Client
+	canceled            chan struct{}
+	metrics             struct {
+		batchSizeBytes       frontreport.MetricHistogram
+		bulkRequestErrors    frontreport.MetricCounter
+		bulkItemErrors       frontreport.MetricCounter
+		bulkItemRetries      frontreport.MetricCounter
+		reportEncodingErrors frontreport.MetricCounter
+		queueFull            frontreport.MetricCounter
+	}
+}
+
+// stopTimeout is how long Stop waits for pending reports to be indexed before canceling retries
+var stopTimeout = 10 * time.Second
+
+// bulkItem is an action line and a document line of a bulk request body
+type bulkItem struct {
+	report     frontreport.Reportable
+	reportType string
+	action     []byte
+	document   []byte
+}
+
+// bulkResponse holds results of bulk request items in the same order as items
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemStatus `json:"items"`
+}
+
+// bulkItemStatus is a result of a bulk request item keyed by its operation
+type bulkItemStatus struct {
+	Status int        `json:"status"`
+	Error  *bulkError `json:"error,omitempty"`
+}
+
+type bulkError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// Start checks index template, puts index template to Elasticsearch and initializes muster batching
+func (rs *ReportStorage) Start() error {
+	rs.metrics.batchSizeBytes = rs.MetricStorage.RegisterHistogram("elasticsearch.batch_size_bytes")
+	rs.metrics.bulkRequestErrors = rs.MetricStorage.RegisterCounter("elasticsearch.bulk_request.errors")
+	rs.metrics.bulkItemErrors = rs.MetricStorage.RegisterCounter("elasticsearch.bulk_item.errors")
+	rs.metrics.bulkItemRetries = rs.MetricStorage.RegisterCounter("elasticsearch.bulk_item.retries")
+	rs.metrics.reportEncodingErrors = rs.MetricStorage.RegisterCounter("elasticsearch.report_encoding.errors")
+	rs.metrics.queueFull = rs.MetricStorage.RegisterCounter("elasticsearch.queue.full")
+
+	if rs.DataStream && rs.Index.Dated() {
+		return fmt.Errorf("index template %s: data streams roll over by themselves, {date} and {week} placeholders are not allowed", rs.Index.Template)
+	}
+
+	rs.canceled = make(chan struct{})
+	rs.client = &http.Client{Timeout: rs.RequestTimeout}
+
+	if rs.TemplateName != "" {
+		if err := rs.putTemplate(); err != nil {
+			return err
+		}
+	}
+
+	rs.muster.MaxBatchSize = rs.MaxBatchSize
+	rs.muster.MaxConcurrentBatches = rs.MaxConcurrentBatches
+	rs.muster.BatchTimeout = rs.BatchTimeout
+	rs.muster.PendingWorkCapacity = rs.PendingWorkCapacity
+	rs.muster.BatchMaker = func() muster.Batch { return &batch{ReportStorage: rs} }
+
+	return rs.muster.Start()
+}
+
+// Stop flushes pending batches and stops muster batching, retries still going on after stopTimeout are canceled
+func (rs *ReportStorage) Stop() error {
+	timer := time.AfterFunc(stopTimeout, func() { close(rs.canceled) })
+	err := rs.muster.Stop()
+	if !timer.Stop() && err == nil {
+		err = errors.New("at least one batch was being retried for too long, had to cancel")
+	}
+	return err
+}
+
+// AddReport adds a report of any type to next batch
+func (rs *ReportStorage) AddReport(report frontreport.Reportable) {
+	document, err := json.Marshal(report)
+	if err != nil {
+		rs.Logger.Log("msg", "failed to encode", "report_type", report.GetType(), "error", err)
+		rs.metrics.reportEncodingErrors.Inc(1)
+		return
+	}
+
+	rs.muster.Work <- rs.newBulkItem(report, document)
+}
+
+// TryAddReport is AddReport which returns false instead of blocking when pending work capacity is exhausted
+func (rs *ReportStorage) TryAddReport(report frontreport.Reportable) bool {
+	document, err := json.Marshal(report)
+	if err != nil {
+		rs.Logger.Log("msg", "failed to encode", "report_type", report.GetType(), "error", err)
+		rs.metrics.reportEncodingErrors.Inc(1)
+		return true
+	}
+
+	select {
+	case rs.muster.Work <- rs.newBulkItem(report, document):
+		return true
+	default:
+		rs.metrics.queueFull.Inc(1)
+		return false
+	}
+}
+
+// SendReports indexes reports with one bulk request without retries and returns the reports worth retrying,
+// reports rejected for good are only logged and counted
+func (rs *ReportStorage) SendReports(reports []frontreport.Reportable) ([]frontreport.Reportable, error) {
+	var items []bulkItem
+	for _, report := range reports {
+		document, err := json.Marshal(report)
+		if err != nil {
+			rs.Logger.Log("msg", "failed to encode", "report_type", report.GetType(), "error", err)
+			rs.metrics.reportEncodingErrors.Inc(1)
+			continue
+		}
+		items = append(items, rs.newBulkItem(report, document))
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	retry, err := rs.bulk(items)
+	if err != nil {
+		rs.metrics.bulkRequestErrors.Inc(1)
+		if len(retry) == 0 {
+			rs.Logger.Log("msg", "failed to send bulk request", "size", len(items), "error", err)
+			rs.metrics.bulkItemErrors.Inc(int64(len(items)))
+			return nil, nil
+		}
+	} else if len(retry) > 0 {
+		err = errors.New("reports rejected due to overload")
+	}
+	return bulkItemReports(retry), err
+}
+
+func (rs *ReportStorage) newBulkItem(report frontreport.Reportable, document []byte) bulkItem {
+	operation := "index"
+	if rs.DataStream {
+		operation = "create"
+	}
+	action, _ := json.Marshal(map[string]map[string]string{operation: {"_index": rs.Index.Name(report, frontreport.ReceivedAt(report))}})
+	return bulkItem{report: report, reportType: report.GetType(), action: action, document: document}
+}
+
+func (rs *ReportStorage) putTemplate() error {
+	template, err := ioutil.ReadFile(rs.TemplateFile)
+	if err != nil {
+		return err
+	}
+	response, err := rs.do("PUT", "/_index_template/"+rs.TemplateName, "application/json", template)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("failed to put index template %s: %s %s", rs.TemplateName, response.Status, body)
+	}
+	return nil
+}
+
+func (rs *ReportStorage) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, strings.TrimSuffix(rs.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	if rs.Username != "" {
+		request.SetBasicAuth(rs.Username, rs.Password)
+	}
+	return rs.client.Do(request)
+}
+
+// bulk sends items in one bulk request and returns items to retry
+func (rs *ReportStorage) bulk(items []bulkItem) ([]bulkItem, error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		body.Write(item.action)
+		body.WriteByte('\n')
+		body.Write(item.document)
+		body.WriteByte('\n')
+	}
+	rs.metrics.batchSizeBytes.Update(int64(body.Len()))
+
+	response, err := rs.do("POST", "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return items, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		err := fmt.Errorf("bulk request failed: %s", response.Status)
+		if isRetryable(response.StatusCode) {
+			return items, err
+		}
+		return nil, err
+	}
+
+	var result bulkResponse
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		// reports are indexed already as long as response is 200, sending them again would duplicate them
+		rs.Logger.Log("msg", "cannot decode bulk response, reports are considered indexed", "size", len(items), "error", err)
+		return nil, nil
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	if len(result.Items) != len(items) {
+		// there is no telling which items failed, so all of them are worth retrying
+		return items, errors.New("bulk response items do not match request items")
+	}
+
+	var retry []bulkItem
+	for i, resultItem := range result.Items {
+		for _, status := range resultItem {
+			if status.Error == nil {
+				continue
+			}
+			if isRetryable(status.Status) {
+				retry = append(retry, items[i])
+				continue
+			}
+			rs.Logger.Log(
+				"msg", "failed to index report",
+				"report_type", items[i].reportType,
+				"status", status.Status,
+				"error_type", status.Error.Type,
+				"error", status.Error.Reason)
+			rs.metrics.bulkItemErrors.Inc(1)
+		}
+	}
+	return retry, nil
+}
+
+func bulkItemReports(items []bulkItem) []frontreport.Reportable {
+	var reports []frontreport.Reportable
+	for _, item := range items {
+		reports = append(reports, item.report)
+	}
+	return reports
+}
+
+// isRetryable tells if a request or an item failed due to overload, temporary unavailability or internal error
+func isRetryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+type batch struct {
+	ReportStorage *ReportStorage
+	Items         []bulkItem
+}
+
+func (b *batch) Add(item interface{}) {
+	b.Items = append(b.Items, item.(bulkItem))
+}
+
+// Fire sends a batch, retrying failed items with exponential backoff unless retries are canceled on stop,
+// items which failed after all retries are passed to FailedReportStorage if there is one
+func (b *batch) Fire(notifier muster.Notifier) {
+	defer notifier.Done()
+	rs := b.ReportStorage
+
+	items := b.Items
+	backoff := rs.RetryBackoff
+	for attempt := 0; len(items) > 0; attempt++ {
+		retry, err := rs.bulk(items)
+		if err != nil {
+			rs.Logger.Log("msg", "failed to send bulk request", "size", len(items), "attempt", attempt+1, "error", err)
+			rs.metrics.bulkRequestErrors.Inc(1)
+		}
+		if len(retry) == 0 {
+			return
+		}
+		if attempt >= rs.MaxRetries {
+			rs.Logger.Log("msg", "giving up retrying bulk items", "size", len(retry))
+			rs.fail(retry)
+			return
+		}
+		select {
+		case <-rs.canceled:
+			rs.Logger.Log("msg", "retrying bulk items canceled on stop", "size", len(retry))
+			rs.fail(retry)
+			return
+		case <-time.After(backoff):
+		}
+		rs.metrics.bulkItemRetries.Inc(int64(len(retry)))
+		backoff *= 2
+		items = retry
+	}
+}
+
+// fail passes items which are still worth indexing to FailedReportStorage if there is one, otherwise they are dropped
+func (rs *ReportStorage) fail(items []bulkItem) {
+	if rs.FailedReportStorage != nil {
+		rs.FailedReportStorage.AddFailedReports(bulkItemReports(items))
+		return
+	}
+	rs.metrics.bulkItemErrors.Inc(int64(len(items)))
+}
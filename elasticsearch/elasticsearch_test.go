@@ -0,0 +1,225 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// fakeElasticsearch rejects the first attempt to index every document with status from statuses by document message
+type fakeElasticsearch struct {
+	mu        sync.Mutex
+	statuses  map[string]int
+	attempts  map[string]int
+	indexed   map[string]string
+	templates map[string]string
+	garbled   bool
+	truncated bool
+}
+
+func (fe *fakeElasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	if r.Method == "PUT" {
+		body, _ := ioutil.ReadAll(r.Body)
+		fe.templates[r.URL.Path] = string(body)
+		return
+	}
+
+	var response bulkResponse
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var action map[string]struct {
+			Index string `json:"_index"`
+		}
+		json.Unmarshal(scanner.Bytes(), &action)
+		scanner.Scan()
+		var document struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(scanner.Bytes(), &document)
+
+		result := bulkItemStatus{Status: http.StatusCreated}
+		fe.attempts[document.Message]++
+		if status, ok := fe.statuses[document.Message]; ok && fe.attempts[document.Message] == 1 {
+			result = bulkItemStatus{Status: status, Error: &bulkError{Type: "some_exception", Reason: "something went wrong"}}
+			response.Errors = true
+		} else {
+			fe.indexed[document.Message] = action["index"].Index
+		}
+		response.Items = append(response.Items, map[string]bulkItemStatus{"index": result})
+	}
+	if fe.garbled {
+		w.Write([]byte("{garbled"))
+		return
+	}
+	if fe.truncated && len(response.Items) > 0 {
+		response.Errors = true
+		response.Items = response.Items[:len(response.Items)-1]
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func stacktraceJSReport(message, service string) *frontreport.StacktraceJSReport {
+	report := &frontreport.StacktraceJSReport{Message: message}
+	report.Service = service
+	return report
+}
+
+// TestReportStorage tests that reports are indexed and failed items are retried
+func TestReportStorage(t *testing.T) {
+	Convey("Given Elasticsearch storage", t, func() {
+		fe := &fakeElasticsearch{
+			statuses:  map[string]int{"overloaded": http.StatusTooManyRequests, "failing": http.StatusInternalServerError, "broken": http.StatusBadRequest},
+			attempts:  make(map[string]int),
+			indexed:   make(map[string]string),
+			templates: make(map[string]string),
+		}
+		server := httptest.NewServer(fe)
+		defer server.Close()
+
+		template, err := ioutil.TempFile("", "template")
+		So(err, ShouldBeNil)
+		defer os.Remove(template.Name())
+		template.WriteString(`{"index_patterns": ["*-report-*"]}`)
+		template.Close()
+
+		metricStorage := frontreporttest.NewMetricStorage()
+		rs := &ReportStorage{
+			URL:                  server.URL,
+			Index:                frontreport.IndexTemplate{Template: "{type}-report-{service}-{date}"},
+			TemplateName:         "frontreport",
+			TemplateFile:         template.Name(),
+			MaxRetries:           3,
+			RetryBackoff:         time.Millisecond,
+			MaxBatchSize:         10,
+			MaxConcurrentBatches: 1,
+			BatchTimeout:         time.Second,
+			PendingWorkCapacity:  10,
+			Logger:               log.NewNopLogger(),
+			MetricStorage:        metricStorage,
+		}
+		So(rs.Start(), ShouldBeNil)
+		So(fe.templates["/_index_template/frontreport"], ShouldEqual, `{"index_patterns": ["*-report-*"]}`)
+
+		Convey("Reports are indexed and failed items are retried", func() {
+			rs.AddReport(stacktraceJSReport("fine", "Billing"))
+			rs.AddReport(stacktraceJSReport("overloaded", ""))
+			rs.AddReport(stacktraceJSReport("failing", "billing"))
+			rs.AddReport(stacktraceJSReport("broken", "billing"))
+			So(rs.Stop(), ShouldBeNil)
+
+			date := time.Now().UTC().Format("2006.01.02")
+			So(fe.indexed, ShouldResemble, map[string]string{
+				"fine":       "stacktracejs-report-billing-" + date,
+				"overloaded": "stacktracejs-report-" + date,
+				"failing":    "stacktracejs-report-billing-" + date,
+			})
+			So(fe.attempts["overloaded"], ShouldEqual, 2)
+			So(fe.attempts["failing"], ShouldEqual, 2)
+			So(fe.attempts["broken"], ShouldEqual, 1)
+			So(metricStorage.Count("elasticsearch.bulk_item.errors"), ShouldEqual, 1)
+		})
+
+		Convey("Reports which failed to index after all retries are passed to failed report storage", func() {
+			failedStorage := &frontreporttest.MemoryStorage{}
+			rs.FailedReportStorage = failedStorage
+			rs.MaxRetries = 0
+			rs.AddReport(stacktraceJSReport("fine", "billing"))
+			rs.AddReport(stacktraceJSReport("overloaded", "billing"))
+			So(rs.Stop(), ShouldBeNil)
+
+			So(failedStorage.Reports(), ShouldHaveLength, 1)
+			So(failedStorage.Reports()[0].(*frontreport.StacktraceJSReport).Message, ShouldEqual, "overloaded")
+			So(metricStorage.Count("elasticsearch.bulk_item.errors"), ShouldEqual, 0)
+		})
+
+		Convey("Sending reports at once returns the ones worth retrying", func() {
+			overloaded := stacktraceJSReport("overloaded", "billing")
+			retry, err := rs.SendReports([]frontreport.Reportable{stacktraceJSReport("fine", "billing"), overloaded, stacktraceJSReport("broken", "billing")})
+			So(err, ShouldNotBeNil)
+			So(retry, ShouldResemble, []frontreport.Reportable{overloaded})
+
+			retry, err = rs.SendReports(retry)
+			So(err, ShouldBeNil)
+			So(retry, ShouldBeEmpty)
+			So(rs.Stop(), ShouldBeNil)
+			So(fe.indexed, ShouldContainKey, "overloaded")
+			So(metricStorage.Count("elasticsearch.bulk_item.errors"), ShouldEqual, 1)
+		})
+
+		Convey("Reports read back from disk are indexed by the day they were received", func() {
+			received := time.Date(2020, 2, 14, 23, 59, 0, 0, time.UTC)
+			report := &frontreport.RawReport{Type: "stacktracejs", Service: "billing", JSON: []byte(`{"message":"received"}`), Time: received}
+			retry, err := rs.SendReports([]frontreport.Reportable{report})
+			So(err, ShouldBeNil)
+			So(retry, ShouldBeEmpty)
+			So(rs.Stop(), ShouldBeNil)
+			So(fe.indexed["received"], ShouldEqual, "stacktracejs-report-billing-2020.02.14")
+		})
+
+		Convey("Data streams are not named by date", func() {
+			So(rs.Stop(), ShouldBeNil)
+			dataStream := &ReportStorage{
+				URL:           server.URL,
+				Index:         frontreport.IndexTemplate{Template: "{type}-report-{service}-{week}"},
+				DataStream:    true,
+				Logger:        log.NewNopLogger(),
+				MetricStorage: metricStorage,
+			}
+			So(dataStream.Start(), ShouldNotBeNil)
+		})
+
+		Convey("Reports are not sent again if response can't be decoded", func() {
+			fe.garbled = true
+			rs.AddReport(stacktraceJSReport("fine", "billing"))
+			So(rs.Stop(), ShouldBeNil)
+			So(fe.attempts["fine"], ShouldEqual, 1)
+		})
+
+		Convey("Reports are retried if response items do not match request items", func() {
+			failedStorage := &frontreporttest.MemoryStorage{}
+			rs.FailedReportStorage = failedStorage
+			rs.MaxRetries = 1
+			fe.truncated = true
+			rs.AddReport(stacktraceJSReport("fine", "billing"))
+			rs.AddReport(stacktraceJSReport("broken", "billing"))
+			So(rs.Stop(), ShouldBeNil)
+
+			So(fe.attempts["fine"], ShouldEqual, 2)
+			So(failedStorage.Reports(), ShouldHaveLength, 2)
+			So(metricStorage.Count("elasticsearch.bulk_item.retries"), ShouldEqual, 2)
+		})
+
+		Convey("Retries are canceled if stop takes too long", func() {
+			defer func(timeout time.Duration) { stopTimeout = timeout }(stopTimeout)
+			stopTimeout = 10 * time.Millisecond
+			rs.RetryBackoff = time.Hour
+			rs.AddReport(stacktraceJSReport("overloaded", "billing"))
+
+			stopped := make(chan error)
+			go func() { stopped <- rs.Stop() }()
+			select {
+			case err := <-stopped:
+				So(err, ShouldNotBeNil)
+			case <-time.After(5 * time.Second):
+				t.Fatal("stop waits for retry backoff")
+			}
+			So(fe.attempts["overloaded"], ShouldEqual, 1)
+			So(metricStorage.Count("elasticsearch.bulk_item.errors"), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,102 @@
+package fanout
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// Child is a named storage reports are forwarded to
+type Child struct {
+	Name          string
+	ReportStorage frontreport.ReportStorage
+}
+
+// ReportStorage forwards every report to all child storages; every child has its own queue and goroutine,
+// so that a slow child can't block others or the caller, reports for a child with full queue are dropped
+// and children that can refuse reports are not waited for either
+type ReportStorage struct {
+	Children      []Child
+	QueueSize     int
+	Logger        frontreport.Logger
+	MetricStorage frontreport.MetricStorage
+	queues        []chan frontreport.Reportable
+	mu            sync.RWMutex
+	stopped       bool
+	wg            sync.WaitGroup
+	metrics       struct {
+		sent    []frontreport.MetricCounter
+		dropped []frontreport.MetricCounter
+		failed  []frontreport.MetricCounter
+	}
+}
+
+// Start initializes metrics and starts forwarding reports to children
+func (rs *ReportStorage) Start() error {
+	for i, child := range rs.Children {
+		rs.metrics.sent = append(rs.metrics.sent, rs.MetricStorage.RegisterCounter(fmt.Sprintf("fanout.%s.sent", child.Name)))
+		rs.metrics.dropped = append(rs.metrics.dropped, rs.MetricStorage.RegisterCounter(fmt.Sprintf("fanout.%s.dropped", child.Name)))
+		rs.metrics.failed = append(rs.metrics.failed, rs.MetricStorage.RegisterCounter(fmt.Sprintf("fanout.%s.failed", child.Name)))
+
+		queue := make(chan frontreport.Reportable, rs.QueueSize)
+		rs.queues = append(rs.queues, queue)
+		rs.wg.Add(1)
+		go rs.forward(i, queue)
+	}
+	return nil
+}
+
+// Stop waits for children to get queued reports, reports added after Stop are dropped
+func (rs *ReportStorage) Stop() error {
+	rs.mu.Lock()
+	if !rs.stopped {
+		rs.stopped = true
+		for _, queue := range rs.queues {
+			close(queue)
+		}
+	}
+	rs.mu.Unlock()
+	rs.wg.Wait()
+	return nil
+}
+
+// AddReport queues a report for every child without waiting for any of them
+func (rs *ReportStorage) AddReport(report frontreport.Reportable) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	for i, queue := range rs.queues {
+		if rs.stopped {
+			rs.metrics.dropped[i].Inc(1)
+			continue
+		}
+		select {
+		case queue <- report:
+		default:
+			rs.metrics.dropped[i].Inc(1)
+		}
+	}
+}
+
+func (rs *ReportStorage) forward(i int, queue chan frontreport.Reportable) {
+	defer rs.wg.Done()
+	for report := range queue {
+		if rs.addReport(i, report) {
+			rs.metrics.sent[i].Inc(1)
+		} else {
+			rs.metrics.failed[i].Inc(1)
+		}
+	}
+}
+
+// addReport passes a report to a child without blocking if the child can refuse it, it returns false
+// if the child refuses the report or panics, a child panic is logged and does not affect other children
+func (rs *ReportStorage) addReport(i int, report frontreport.Reportable) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			rs.Logger.Log("msg", "storage failed to add report", "storage", rs.Children[i].Name, "report_type", report.GetType(), "error", err)
+			ok = false
+		}
+	}()
+	return frontreport.PassReport(rs.Children[i].ReportStorage, report, false)
+}
@@ -0,0 +1,116 @@
+package fanout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// blockedStorage blocks on every report until unblocked and tells when it gets the first one
+type blockedStorage struct {
+	received chan struct{}
+	unblock  chan struct{}
+}
+
+func (bs *blockedStorage) AddReport(report frontreport.Reportable) {
+	select {
+	case bs.received <- struct{}{}:
+	default:
+	}
+	<-bs.unblock
+}
+
+// fullStorage refuses every report it can refuse
+type fullStorage struct{}
+
+func (fs fullStorage) AddReport(report frontreport.Reportable) {
+	panic("full storage blocks")
+}
+
+func (fs fullStorage) TryAddReport(report frontreport.Reportable) bool {
+	return false
+}
+
+type brokenStorage struct{}
+
+func (bs brokenStorage) AddReport(report frontreport.Reportable) {
+	panic("broken")
+}
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+// TestReportStorage tests that every child gets reports regardless of other children
+func TestReportStorage(t *testing.T) {
+	Convey("Given fan-out to working, blocked, full and broken storages", t, func() {
+		working := &frontreporttest.MemoryStorage{}
+		blocked := &blockedStorage{received: make(chan struct{}, 1), unblock: make(chan struct{})}
+		metricStorage := frontreporttest.NewMetricStorage()
+		rs := &ReportStorage{
+			Children: []Child{
+				{Name: "working", ReportStorage: working},
+				{Name: "blocked", ReportStorage: blocked},
+				{Name: "full", ReportStorage: fullStorage{}},
+				{Name: "broken", ReportStorage: brokenStorage{}},
+			},
+			QueueSize:     2,
+			Logger:        log.NewNopLogger(),
+			MetricStorage: metricStorage,
+		}
+		So(rs.Start(), ShouldBeNil)
+
+		// a report is added only after other children have got the previous one,
+		// so that only the blocked child drops reports
+		added := make(chan struct{})
+		go func() {
+			defer close(added)
+			for i := 1; i <= 10; i++ {
+				rs.AddReport(&frontreport.CSPReport{})
+				if i == 1 {
+					<-blocked.received
+				}
+				waitFor(func() bool {
+					return int64(len(working.Reports())) == int64(i) && metricStorage.Count("fanout.full.failed") == int64(i) &&
+						metricStorage.Count("fanout.broken.failed") == int64(i)
+				})
+			}
+		}()
+		select {
+		case <-added:
+		case <-time.After(5 * time.Second):
+			t.Fatal("blocked child blocked adding reports")
+		}
+
+		So(working.Reports(), ShouldHaveLength, 10)
+		So(metricStorage.Count("fanout.working.sent"), ShouldEqual, 10)
+		So(metricStorage.Count("fanout.broken.failed"), ShouldEqual, 10)
+		So(metricStorage.Count("fanout.broken.dropped"), ShouldEqual, 0)
+		So(metricStorage.Count("fanout.full.failed"), ShouldEqual, 10)
+		So(metricStorage.Count("fanout.full.sent"), ShouldEqual, 0)
+		// one report is being added to the blocked child and two more wait in its queue
+		So(metricStorage.Count("fanout.blocked.dropped"), ShouldEqual, 7)
+
+		close(blocked.unblock)
+		So(rs.Stop(), ShouldBeNil)
+		So(metricStorage.Count("fanout.blocked.sent"), ShouldEqual, 3)
+
+		Convey("Reports added after stop are dropped", func() {
+			So(func() { rs.AddReport(&frontreport.CSPReport{}) }, ShouldNotPanic)
+			So(metricStorage.Count("fanout.working.dropped"), ShouldEqual, 1)
+			So(working.Reports(), ShouldHaveLength, 10)
+			So(rs.Stop(), ShouldBeNil)
+		})
+	})
+}
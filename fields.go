@@ -0,0 +1,78 @@
+package frontreport
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ReportField returns value of a report field by its JSON name, names of nested fields are separated by dots;
+// a single name is looked up in nested objects too, e.g. "violated-directive" finds "csp-report.violated-directive"
+func ReportField(report Reportable, name string) (string, bool) {
+	path := strings.Split(name, ".")
+	field, found := lookupField(reflect.ValueOf(report), path, len(path) == 1)
+	if !found {
+		return "", false
+	}
+	switch field.Kind() {
+	case reflect.String:
+		return field.String(), true
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return fmt.Sprint(field.Interface()), true
+	}
+	return "", false
+}
+
+// lookupField finds a struct field by JSON names path, fields of the struct itself and embedded structs
+// go before fields of nested objects, which are searched only if deep is set
+func lookupField(v reflect.Value, path []string, deep bool) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if structField.PkgPath != "" {
+			continue
+		}
+		name := jsonName(structField)
+		if structField.Anonymous && name == "" {
+			if field, found := lookupField(v.Field(i), path, false); found {
+				return field, true
+			}
+		} else if name == path[0] {
+			if len(path) == 1 {
+				return v.Field(i), true
+			}
+			return lookupField(v.Field(i), path[1:], false)
+		}
+	}
+
+	if deep {
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath == "" && jsonName(t.Field(i)) != "-" {
+				if field, found := lookupField(v.Field(i), path, true); found {
+					return field, true
+				}
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// jsonName returns name of a field in JSON, it is empty for embedded structs without a name tag
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" && !field.Anonymous {
+		return field.Name
+	}
+	return name
+}
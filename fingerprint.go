@@ -0,0 +1,92 @@
+package frontreport
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxFingerprintFrames is how many top in-app frames identify an error, deeper frames are usually framework internals
+const maxFingerprintFrames = 10
+
+var (
+	messagePrefixRegexp  = regexp.MustCompile(`^Uncaught\s+(\(in promise\)\s+)?`)
+	messageURLRegexp     = regexp.MustCompile(`[a-z][a-z0-9+.-]*://\S+`)
+	messageQuotedRegexp  = regexp.MustCompile(`"[^"]*"|'[^']*'|` + "`[^`]*`")
+	messageNumberRegexp  = regexp.MustCompile(`\b(0x[0-9a-fA-F]+|\d+(\.\d+)?)\b`)
+	messageSpaceRegexp   = regexp.MustCompile(`\s+`)
+	bundleHashRegexp     = regexp.MustCompile(`[.\-_~][0-9a-fA-F]{8,}(\.|$)`)
+	thirdPartyPathRegexp = regexp.MustCompile(`(^|/)(node_modules|bower_components|vendor|~)/`)
+)
+
+// StacktraceJSFingerprint identifies an error regardless of browser, release and sourcemaps availability:
+// it hashes normalized message and top in-app frames with stripped hosts, query strings and bundle hashes
+func StacktraceJSFingerprint(report *StacktraceJSReport) string {
+	frames := make([]string, 0, maxFingerprintFrames)
+	for _, frame := range report.Stack {
+		if len(frames) == maxFingerprintFrames {
+			break
+		}
+		if file, inApp := normalizeFrameFile(frame.FileName); inApp {
+			frames = append(frames, file+":"+normalizeFrameFunction(frame))
+		}
+	}
+
+	hash := sha1.New()
+	hash.Write([]byte(normalizeMessage(report.Message)))
+	for _, frame := range frames {
+		hash.Write([]byte("\n" + frame))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// normalizeMessage removes browser-specific prefixes and values that differ between occurrences of the same error
+func normalizeMessage(message string) string {
+	message = messagePrefixRegexp.ReplaceAllString(strings.TrimSpace(message), "")
+	message = messageURLRegexp.ReplaceAllString(message, "<url>")
+	message = messageQuotedRegexp.ReplaceAllString(message, "<str>")
+	message = messageNumberRegexp.ReplaceAllString(message, "<num>")
+	return messageSpaceRegexp.ReplaceAllString(message, " ")
+}
+
+// normalizeFrameFile returns frame file path without host, query string and bundle hashes,
+// frames from browser extensions, third-party libraries and browser internals are not in-app
+func normalizeFrameFile(fileName string) (string, bool) {
+	if fileName == "" || fileName == "<anonymous>" || fileName == "native" {
+		return "", false
+	}
+	filePath := fileName
+	if u, err := url.Parse(fileName); err == nil {
+		switch u.Scheme {
+		case "http", "https", "webpack", "":
+			filePath = u.Path
+		default:
+			// chrome-extension://, moz-extension://, blob:, eval code and alike
+			return "", false
+		}
+		if u.Opaque != "" {
+			filePath = u.Opaque
+		}
+	} else if i := strings.IndexAny(filePath, "?#"); i >= 0 {
+		filePath = filePath[:i]
+	}
+	if thirdPartyPathRegexp.MatchString(filePath) {
+		return "", false
+	}
+
+	dir, file := path.Split(path.Clean(filePath))
+	file = bundleHashRegexp.ReplaceAllString(file, "$1")
+	return dir + file, true
+}
+
+// normalizeFrameFunction prefers function name as line numbers shift between releases
+func normalizeFrameFunction(frame StacktraceJSStackframe) string {
+	if frame.FunctionName != "" {
+		return frame.FunctionName
+	}
+	return strconv.Itoa(frame.LineNumber)
+}
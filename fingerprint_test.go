@@ -0,0 +1,68 @@
+package frontreport
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// TestStacktraceJSFingerprint tests that the same error gets the same fingerprint across browsers and releases
+func TestStacktraceJSFingerprint(t *testing.T) {
+	Convey("Same error in different releases and browsers", t, func() {
+		chrome := &StacktraceJSReport{
+			Message: "Uncaught TypeError: Cannot read property 'id' of undefined",
+			Stack: []StacktraceJSStackframe{
+				{FunctionName: "loadUser", FileName: "https://cdn1.example.com/static/main.3f2a9c1b.js?v=12", LineNumber: 1, ColumnNumber: 3021},
+				{FunctionName: "dispatch", FileName: "https://cdn1.example.com/static/vendor/react-dom.js", LineNumber: 1, ColumnNumber: 10},
+				{FunctionName: "handleClick", FileName: "https://cdn1.example.com/static/main.3f2a9c1b.js", LineNumber: 1, ColumnNumber: 2000},
+			},
+		}
+		nextRelease := &StacktraceJSReport{
+			Message: "TypeError: Cannot read property \"name\" of undefined",
+			Stack: []StacktraceJSStackframe{
+				{FunctionName: "loadUser", FileName: "https://cdn2.example.com/static/main.9d8e7f60.js", LineNumber: 1, ColumnNumber: 4410},
+				{FunctionName: "handleClick", FileName: "https://cdn2.example.com/static/main.9d8e7f60.js#top", LineNumber: 1, ColumnNumber: 2900},
+				{FunctionName: "", FileName: "chrome-extension://abcdef/content.js", LineNumber: 7, ColumnNumber: 1},
+			},
+		}
+		So(StacktraceJSFingerprint(nextRelease), ShouldEqual, StacktraceJSFingerprint(chrome))
+	})
+
+	Convey("Different errors", t, func() {
+		first := &StacktraceJSReport{
+			Message: "TypeError: x is undefined",
+			Stack:   []StacktraceJSStackframe{{FunctionName: "a", FileName: "https://example.com/app.js"}},
+		}
+		otherMessage := &StacktraceJSReport{
+			Message: "ReferenceError: x is not defined",
+			Stack:   []StacktraceJSStackframe{{FunctionName: "a", FileName: "https://example.com/app.js"}},
+		}
+		otherFunction := &StacktraceJSReport{
+			Message: "TypeError: x is undefined",
+			Stack:   []StacktraceJSStackframe{{FunctionName: "b", FileName: "https://example.com/app.js"}},
+		}
+		So(StacktraceJSFingerprint(otherMessage), ShouldNotEqual, StacktraceJSFingerprint(first))
+		So(StacktraceJSFingerprint(otherFunction), ShouldNotEqual, StacktraceJSFingerprint(first))
+	})
+
+	Convey("Normalizing frame files", t, func() {
+		for fileName, expected := range map[string]string{
+			"https://example.com/js/app-0123abcd.js?x=1": "/js/app.js",
+			"webpack:///./src/components/Form.jsx":       "/src/components/Form.jsx",
+			"/static/chunk.deadbeef99.js":                "/static/chunk.js",
+		} {
+			file, inApp := normalizeFrameFile(fileName)
+			So(inApp, ShouldBeTrue)
+			So(file, ShouldEqual, expected)
+		}
+		for _, fileName := range []string{
+			"",
+			"<anonymous>",
+			"moz-extension://1234/script.js",
+			"webpack:///./node_modules/lodash/lodash.js",
+		} {
+			_, inApp := normalizeFrameFile(fileName)
+			So(inApp, ShouldBeFalse)
+		}
+	})
+}
@@ -1,6 +1,13 @@
 package frontreport
 
-import "strings"
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// TimestampFormat is the format of report timestamps, Elastic parses it as a date
+const TimestampFormat = "2006-01-02T15:04:05.999Z"
 
 // Reportable structs can be saved to Elastic
 // - their Type and Service defines index to save to;
@@ -14,9 +21,10 @@ type Reportable interface {
 
 // Report is a generic report type (they don't have much in common)
 type Report struct {
-	Timestamp string `json:"@timestamp"`
-	Host      string `json:"frontreport-host"`
-	Service   string `json:"service"`
+	Timestamp  string  `json:"@timestamp"`
+	Host       string  `json:"frontreport-host"`
+	Service    string  `json:"service"`
+	SampleRate float64 `json:"sample_rate,omitempty"`
 }
 
 // SetTimestamp sets timestamp for Elastic default sorting
@@ -29,6 +37,21 @@ func (r *Report) SetHost(h string) {
 	r.Host = h
 }
 
+// GetHost returns hostname the report was sent to
+func (r *Report) GetHost() string {
+	return r.Host
+}
+
+// SetService sets service of a report which does not tell it itself
+func (r *Report) SetService(s string) {
+	r.Service = s
+}
+
+// SetSampleRate records probability of a report to be stored, so that aggregations can be re-weighted
+func (r *Report) SetSampleRate(rate float64) {
+	r.SampleRate = rate
+}
+
 // GetService returns service to tell apart reports from different sites
 func (r *Report) GetService() string {
 	return strings.ToLower(r.Service)
@@ -44,7 +67,19 @@ type CSPReport struct {
 		ViolatedDirective  string `json:"violated-directive"`
 		EffectiveDirective string `json:"effective-directive"`
 		OriginalPolicy     string `json:"original-policy"`
+		SourceFile         string `json:"source-file,omitempty"`
+		LineNumber         int    `json:"line-number,omitempty"`
+		ColumnNumber       int    `json:"column-number,omitempty"`
+		ScriptSample       string `json:"script-sample,omitempty"`
+		Disposition        string `json:"disposition,omitempty"`
+		StatusCode         int    `json:"status-code,omitempty"`
 	} `json:"csp-report"`
+
+	// Normalized fields are calculated by frontreport, see CSPReport.Normalize
+	Normalized CSPNormalized `json:"normalized"`
+
+	// Tags are names of noise filter rules the report matched
+	Tags []string `json:"tags,omitempty"`
 }
 
 // GetType returns report type
@@ -71,6 +106,30 @@ func (p PKPReport) GetType() string {
 	return "pkp"
 }
 
+// ExpectCTReport is a Certificate Transparency report as per https://tools.ietf.org/html/draft-ietf-httpbis-expect-ct-08
+type ExpectCTReport struct {
+	Report
+	Body struct {
+		DateTime                  string   `json:"date-time"`
+		Hostname                  string   `json:"hostname"`
+		Port                      int      `json:"port"`
+		EffectiveExpirationDate   string   `json:"effective-expiration-date"`
+		ServedCertificateChain    []string `json:"served-certificate-chain"`
+		ValidatedCertificateChain []string `json:"validated-certificate-chain"`
+		SCTs                      []struct {
+			Version       int    `json:"version"`
+			Status        string `json:"status"`
+			Source        string `json:"source"`
+			SerializedSCT string `json:"serialized_sct"`
+		} `json:"scts"`
+	} `json:"expect-ct-report"`
+}
+
+// GetType returns report type
+func (e ExpectCTReport) GetType() string {
+	return "expectct"
+}
+
 // StacktraceJSStackframe is a single stack frame representation
 type StacktraceJSStackframe struct {
 	FunctionName string `json:"functionName"`
@@ -107,6 +166,9 @@ type StacktraceJSReport struct {
 	RetailUIVersion string `json:"retailUiVersion,omitempty"`
 	AppVersion      string `json:"appVersion,omitempty"`
 	ClaimID         string `json:"claimId,omitempty"`
+
+	// Fingerprint is calculated by frontreport after sourcemaps are applied, see StacktraceJSFingerprint
+	Fingerprint string `json:"fingerprint,omitempty"`
 }
 
 // GetType returns report type
@@ -114,11 +176,290 @@ func (s StacktraceJSReport) GetType() string {
 	return "stacktracejs"
 }
 
+// GetStackHash returns stacktrace hash calculated by client
+func (s *StacktraceJSReport) GetStackHash() string {
+	return s.StackHash
+}
+
+// GetStack returns stack frames
+func (s *StacktraceJSReport) GetStack() []StacktraceJSStackframe {
+	return s.Stack
+}
+
+// SetStack replaces stack frames, e.g. with ones resolved by sourcemaps
+func (s *StacktraceJSReport) SetStack(stack []StacktraceJSStackframe) {
+	s.Stack = stack
+}
+
+// GetFingerprint returns fingerprint calculated by frontreport
+func (s *StacktraceJSReport) GetFingerprint() string {
+	return s.Fingerprint
+}
+
+// GetUserID returns ID of the user who got the error
+func (s *StacktraceJSReport) GetUserID() string {
+	return s.UserID
+}
+
+// GetURL returns URL of the page where the error happened
+func (s *StacktraceJSReport) GetURL() string {
+	return s.URL
+}
+
+// ReportingAPIReport holds fields common to all reports delivered by W3C Reporting API as per https://w3c.github.io/reporting/
+type ReportingAPIReport struct {
+	Report
+	Age       int64  `json:"age"`
+	URL       string `json:"url"`
+	UserAgent string `json:"user_agent"`
+}
+
+// CSPViolationReport is a CSP Level 3 violation report as per https://w3c.github.io/webappsec-csp/#reporting
+type CSPViolationReport struct {
+	ReportingAPIReport
+	Body struct {
+		DocumentURL        string `json:"documentURL"`
+		Referrer           string `json:"referrer,omitempty"`
+		BlockedURL         string `json:"blockedURL,omitempty"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		OriginalPolicy     string `json:"originalPolicy"`
+		SourceFile         string `json:"sourceFile,omitempty"`
+		Sample             string `json:"sample,omitempty"`
+		Disposition        string `json:"disposition"`
+		StatusCode         int    `json:"statusCode"`
+		LineNumber         int    `json:"lineNumber,omitempty"`
+		ColumnNumber       int    `json:"columnNumber,omitempty"`
+	} `json:"body"`
+
+	// Tags are names of noise filter rules the report matched
+	Tags []string `json:"tags,omitempty"`
+}
+
+// GetType returns report type
+func (c CSPViolationReport) GetType() string {
+	return "csp-violation"
+}
+
+// DeprecationReport is a deprecated API usage report as per https://wicg.github.io/deprecation-reporting/
+type DeprecationReport struct {
+	ReportingAPIReport
+	Body struct {
+		ID                 string `json:"id"`
+		AnticipatedRemoval string `json:"anticipatedRemoval,omitempty"`
+		Message            string `json:"message"`
+		SourceFile         string `json:"sourceFile,omitempty"`
+		LineNumber         int    `json:"lineNumber,omitempty"`
+		ColumnNumber       int    `json:"columnNumber,omitempty"`
+	} `json:"body"`
+}
+
+// GetType returns report type
+func (d DeprecationReport) GetType() string {
+	return "deprecation"
+}
+
+// InterventionReport is a browser intervention report as per https://wicg.github.io/intervention-reporting/
+type InterventionReport struct {
+	ReportingAPIReport
+	Body struct {
+		ID           string `json:"id"`
+		Message      string `json:"message"`
+		SourceFile   string `json:"sourceFile,omitempty"`
+		LineNumber   int    `json:"lineNumber,omitempty"`
+		ColumnNumber int    `json:"columnNumber,omitempty"`
+	} `json:"body"`
+}
+
+// GetType returns report type
+func (i InterventionReport) GetType() string {
+	return "intervention"
+}
+
+// CrashReport is a browser crash report as per https://wicg.github.io/crash-reporting/
+type CrashReport struct {
+	ReportingAPIReport
+	Body struct {
+		Reason string `json:"reason,omitempty"`
+	} `json:"body"`
+}
+
+// GetType returns report type
+func (c CrashReport) GetType() string {
+	return "crash"
+}
+
+// NELReport is a Network Error Logging report as per https://w3c.github.io/network-error-logging/
+type NELReport struct {
+	ReportingAPIReport
+	Body struct {
+		Referrer         string              `json:"referrer,omitempty"`
+		SamplingFraction float64             `json:"sampling_fraction"`
+		ServerIP         string              `json:"server_ip,omitempty"`
+		Protocol         string              `json:"protocol,omitempty"`
+		Method           string              `json:"method,omitempty"`
+		RequestHeaders   map[string][]string `json:"request_headers,omitempty"`
+		ResponseHeaders  map[string][]string `json:"response_headers,omitempty"`
+		StatusCode       int                 `json:"status_code,omitempty"`
+		ElapsedTime      int64               `json:"elapsed_time"`
+		Phase            string              `json:"phase"`
+		Type             string              `json:"type"`
+	} `json:"body"`
+}
+
+// GetType returns report type
+func (n NELReport) GetType() string {
+	return "nel"
+}
+
+// COEPReport is a Cross-Origin-Embedder-Policy violation report as per https://html.spec.whatwg.org/multipage/origin.html#coep-report-type
+type COEPReport struct {
+	ReportingAPIReport
+	Body struct {
+		Type        string `json:"type"`
+		BlockedURL  string `json:"blockedURL"`
+		Destination string `json:"destination,omitempty"`
+		Disposition string `json:"disposition"`
+	} `json:"body"`
+}
+
+// GetType returns report type
+func (c COEPReport) GetType() string {
+	return "coep"
+}
+
+// COOPReport is a Cross-Origin-Opener-Policy violation report as per https://html.spec.whatwg.org/multipage/origin.html#coop-violation-report-type
+type COOPReport struct {
+	ReportingAPIReport
+	Body struct {
+		Type                string `json:"type"`
+		Disposition         string `json:"disposition"`
+		EffectivePolicy     string `json:"effectivePolicy"`
+		PreviousResponseURL string `json:"previousResponseURL,omitempty"`
+		NextResponseURL     string `json:"nextResponseURL,omitempty"`
+		OpenerURL           string `json:"openerURL,omitempty"`
+		OpenedWindowURL     string `json:"openedWindowURL,omitempty"`
+		OtherDocumentURL    string `json:"otherDocumentURL,omitempty"`
+		Referrer            string `json:"referrer,omitempty"`
+		Property            string `json:"property,omitempty"`
+		SourceFile          string `json:"sourceFile,omitempty"`
+		LineNumber          int    `json:"lineNumber,omitempty"`
+		ColumnNumber        int    `json:"columnNumber,omitempty"`
+	} `json:"body"`
+}
+
+// GetType returns report type
+func (c COOPReport) GetType() string {
+	return "coop"
+}
+
+// StackReport is a report with a stacktrace that can be made readable by SourcemapProcessor
+type StackReport interface {
+	Reportable
+	GetStack() []StacktraceJSStackframe
+	SetStack([]StacktraceJSStackframe)
+}
+
+// FingerprintReport is a report that can be grouped with others describing the same problem
+type FingerprintReport interface {
+	Reportable
+	GetFingerprint() string
+}
+
+// HostReport is a report which knows hostname it was sent to
+type HostReport interface {
+	Reportable
+	GetHost() string
+}
+
+// ServiceReport is a report which service can be set by frontreport, e.g. from request URL
+type ServiceReport interface {
+	Reportable
+	SetService(string)
+}
+
+// SampledReport is a report that can record probability of being stored
+type SampledReport interface {
+	Reportable
+	SetSampleRate(float64)
+}
+
 // ReportStorage is a way to store incoming reports
 type ReportStorage interface {
 	AddReport(Reportable)
 }
 
+// NonBlockingReportStorage is a storage which can refuse a report instead of blocking when its queue is full
+type NonBlockingReportStorage interface {
+	ReportStorage
+	TryAddReport(Reportable) bool
+}
+
+// PassReport adds a report to a storage, unless block is set it returns false instead of blocking
+// when the storage is saturated; storages that can't refuse reports always accept them
+func PassReport(storage ReportStorage, report Reportable, block bool) bool {
+	if nonBlocking, ok := storage.(NonBlockingReportStorage); ok && !block {
+		return nonBlocking.TryAddReport(report)
+	}
+	storage.AddReport(report)
+	return true
+}
+
+// ReportSender is a storage that can send a batch of reports synchronously, it returns reports
+// which failed to send and are worth sending again later along with the error
+type ReportSender interface {
+	SendReports([]Reportable) ([]Reportable, error)
+}
+
+// FailedReportStorage keeps reports a storage failed to send after all retries, so that they are not lost
+type FailedReportStorage interface {
+	AddFailedReports([]Reportable)
+}
+
+// RawReport is an already encoded report, e.g. read back from disk, it is encoded as is
+type RawReport struct {
+	Type    string
+	Service string
+	Host    string
+	JSON    json.RawMessage
+	// Time is when the report was received, it is zero if unknown
+	Time time.Time
+}
+
+// GetType returns report type
+func (r *RawReport) GetType() string {
+	return r.Type
+}
+
+// GetService returns report service
+func (r *RawReport) GetService() string {
+	return r.Service
+}
+
+// GetHost returns report host
+func (r *RawReport) GetHost() string {
+	return r.Host
+}
+
+// SetTimestamp does nothing, raw report already has its timestamp
+func (r *RawReport) SetTimestamp(string) {}
+
+// SetHost does nothing, raw report already has its host
+func (r *RawReport) SetHost(string) {}
+
+// MarshalJSON returns encoded report
+func (r *RawReport) MarshalJSON() ([]byte, error) {
+	return r.JSON, nil
+}
+
+// ReceivedAt tells when a report was received, so that a report sent long after that, e.g. read back from disk,
+// is stored to the index of the day it was received; it is now for any report but a raw one that knows its time
+func ReceivedAt(report Reportable) time.Time {
+	if rawReport, ok := report.(*RawReport); ok && !rawReport.Time.IsZero() {
+		return rawReport.Time
+	}
+	return time.Now()
+}
+
 // SourcemapProcessor converts stacktrace to readable format using sourcemaps
 type SourcemapProcessor interface {
 	ProcessStack([]StacktraceJSStackframe) []StacktraceJSStackframe
@@ -3,91 +3,282 @@ package hercules
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"time"
 
+	"github.com/facebookgo/muster"
+
 	"github.com/skbkontur/frontreport"
 )
 
-// ReportStorage is a Hercules implementation of frontreport.ReportStorage interface
+// ReportStorage is a Hercules implementation of frontreport.ReportStorage interface, reports are queued
+// and sent in batches by background workers, Hercules logs API takes a document per request,
+// so reports of a batch are sent index by index, every report is a separate request over a shared keep-alive connection
 type ReportStorage struct {
-	Logger           frontreport.Logger
-	MetricStorage    frontreport.MetricStorage
-	HerculesEndpoint string
-	HerculesAPIKey   string
-	metrics          struct {
+	Logger               frontreport.Logger
+	MetricStorage        frontreport.MetricStorage
+	HerculesEndpoint     string
+	HerculesAPIKey       string
+	Index                frontreport.IndexTemplate
+	MaxRetries           int
+	RetryBackoff         time.Duration
+	RequestTimeout       time.Duration
+	MaxBatchSize         uint
+	MaxConcurrentBatches uint
+	BatchTimeout         time.Duration
+	PendingWorkCapacity  uint
+	// FailedReportStorage gets reports which failed to send after all retries instead of dropping them
+	FailedReportStorage frontreport.FailedReportStorage
+	client              *http.Client
+	muster              muster.Client
+	canceled            chan struct{}
+	metrics             struct {
+		documentSizeBytes    frontreport.MetricHistogram
 		reportEncodingErrors frontreport.MetricCounter
 		adapterRequestTotal  frontreport.MetricCounter
 		adapterRequestErrors frontreport.MetricCounter
+		adapterRequestRetry  frontreport.MetricCounter
+		reportsDropped       frontreport.MetricCounter
+		queueFull            frontreport.MetricCounter
 	}
 }
 
-// Start initializes metrics
+// stopTimeout is how long Stop waits for pending reports to be sent before canceling retries
+var stopTimeout = 10 * time.Second
+
+// item is an encoded report waiting for a batch
+type item struct {
+	report     frontreport.Reportable
+	index      string
+	reportType string
+	document   json.RawMessage
+}
+
+// Start initializes metrics, HTTP client and muster batching
 func (rs *ReportStorage) Start() error {
+	rs.metrics.documentSizeBytes = rs.MetricStorage.RegisterHistogram("hercules.document_size_bytes")
 	rs.metrics.reportEncodingErrors = rs.MetricStorage.RegisterCounter("hercules.report_encoding.errors")
 	rs.metrics.adapterRequestTotal = rs.MetricStorage.RegisterCounter("hercules.adapter_request.total")
 	rs.metrics.adapterRequestErrors = rs.MetricStorage.RegisterCounter("hercules.adapter_request.errors")
+	rs.metrics.adapterRequestRetry = rs.MetricStorage.RegisterCounter("hercules.adapter_request.retries")
+	rs.metrics.reportsDropped = rs.MetricStorage.RegisterCounter("hercules.reports.dropped")
+	rs.metrics.queueFull = rs.MetricStorage.RegisterCounter("hercules.queue.full")
+
+	rs.canceled = make(chan struct{})
+	rs.client = &http.Client{
+		Timeout: rs.RequestTimeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: int(rs.MaxConcurrentBatches) + 1,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
 
-	return nil
+	rs.muster.MaxBatchSize = rs.MaxBatchSize
+	rs.muster.MaxConcurrentBatches = rs.MaxConcurrentBatches
+	rs.muster.BatchTimeout = rs.BatchTimeout
+	rs.muster.PendingWorkCapacity = rs.PendingWorkCapacity
+	rs.muster.BatchMaker = func() muster.Batch { return &batch{ReportStorage: rs} }
+
+	return rs.muster.Start()
 }
 
-// Stop does nothing
+// Stop sends pending batches and stops muster batching, retries still going on after stopTimeout are canceled
 func (rs *ReportStorage) Stop() error {
-	return nil
+	timer := time.AfterFunc(stopTimeout, func() { close(rs.canceled) })
+	err := rs.muster.Stop()
+	if !timer.Stop() && err == nil {
+		err = errors.New("at least one report was being retried for too long, had to cancel")
+	}
+	return err
 }
 
-// AddReport directly sends a report to Hercules without any batching
+// AddReport adds a report of any type to next batch
 func (rs *ReportStorage) AddReport(report frontreport.Reportable) {
-	reportJSON, err := json.Marshal(report)
+	it, err := rs.newItem(report)
 	if err != nil {
 		rs.Logger.Log("msg", "failed to encode", "report_type", report.GetType(), "error", err)
 		rs.metrics.reportEncodingErrors.Inc(1)
 		return
 	}
+	rs.muster.Work <- it
+}
 
-	var indexName string
-	if report.GetService() != "" {
-		indexName = fmt.Sprintf("%s-report-%s-%s", report.GetType(), report.GetService(), time.Now().UTC().Format("2006.01.02"))
-	} else {
-		indexName = fmt.Sprintf("%s-report-%s", report.GetType(), time.Now().UTC().Format("2006.01.02"))
+// TryAddReport is AddReport which returns false instead of blocking when pending work capacity is exhausted
+func (rs *ReportStorage) TryAddReport(report frontreport.Reportable) bool {
+	it, err := rs.newItem(report)
+	if err != nil {
+		rs.Logger.Log("msg", "failed to encode", "report_type", report.GetType(), "error", err)
+		rs.metrics.reportEncodingErrors.Inc(1)
+		return true
 	}
+	select {
+	case rs.muster.Work <- it:
+		return true
+	default:
+		rs.metrics.queueFull.Inc(1)
+		return false
+	}
+}
+
+// SendReports sends reports to Hercules at once without retries, it stops at the first temporary failure
+// and returns the reports left, as the rest would most likely fail too; rejected reports are dropped
+func (rs *ReportStorage) SendReports(reports []frontreport.Reportable) ([]frontreport.Reportable, error) {
+	for i, report := range reports {
+		it, err := rs.newItem(report)
+		if err != nil {
+			rs.Logger.Log("msg", "failed to encode", "report_type", report.GetType(), "error", err)
+			rs.metrics.reportEncodingErrors.Inc(1)
+			continue
+		}
+
+		retry, err := rs.post(it)
+		if err == nil {
+			continue
+		}
+		if retry {
+			return reports[i:], err
+		}
+		rs.Logger.Log("msg", "failed to send report to Hercules API", "report_type", it.reportType, "error", err)
+		rs.metrics.reportsDropped.Inc(1)
+	}
+	return nil, nil
+}
+
+func (rs *ReportStorage) newItem(report frontreport.Reportable) (item, error) {
+	document, err := json.Marshal(report)
+	if err != nil {
+		return item{}, err
+	}
+
+	return item{report: report, index: rs.Index.Name(report, frontreport.ReceivedAt(report)), reportType: report.GetType(), document: document}, nil
+}
 
+// post sends a document to its index, it tells if a failed request is worth retrying:
+// network errors, overload and server errors are temporary, other responses mean that the report is rejected
+func (rs *ReportStorage) post(it item) (bool, error) {
+	rs.metrics.documentSizeBytes.Update(int64(len(it.document)))
 	rs.metrics.adapterRequestTotal.Inc(1)
 
-	client := http.Client{}
 	request, err := http.NewRequest(
 		"POST",
-		fmt.Sprintf("%s/logs/%s", rs.HerculesEndpoint, indexName),
-		bytes.NewReader(reportJSON))
+		fmt.Sprintf("%s/logs/%s", rs.HerculesEndpoint, it.index),
+		bytes.NewReader(it.document))
 	if err != nil {
-		rs.Logger.Log(
-			"msg", "failed to initialize request to Hercules API",
-			"report_type", report.GetType(),
-			"error", err)
 		rs.metrics.adapterRequestErrors.Inc(1)
-		return
+		return false, fmt.Errorf("failed to initialize request to Hercules API: %s", err)
 	}
 
 	request.Header.Add("Content-Type", "application/json")
 	request.Header.Add("Authorization", "ELK "+rs.HerculesAPIKey)
 
-	response, err := client.Do(request)
+	response, err := rs.client.Do(request)
 	if err != nil {
-		rs.Logger.Log(
-			"msg", "failed to send request to Hercules API",
-			"report_type", report.GetType(),
-			"error", err)
 		rs.metrics.adapterRequestErrors.Inc(1)
-		return
+		return true, err
 	}
 	defer response.Body.Close()
+	// the body is drained, so that the connection can be reused
+	io.Copy(ioutil.Discard, response.Body)
 
-	if response.StatusCode != 200 {
-		rs.Logger.Log(
-			"msg", "non-200 response code from Hercules API",
-			"report_type", report.GetType(),
-			"response_code", response.StatusCode)
+	if response.StatusCode != http.StatusOK {
 		rs.metrics.adapterRequestErrors.Inc(1)
+		err := fmt.Errorf("non-200 response code from Hercules API: %d", response.StatusCode)
+		return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500, err
+	}
+	return false, nil
+}
+
+// send posts a document retrying failed requests with exponential backoff unless retries are canceled on stop,
+// it returns false if the report is still worth sending after giving up
+func (rs *ReportStorage) send(it item) bool {
+	backoff := rs.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-rs.canceled:
+			rs.Logger.Log("msg", "sending report canceled on stop", "index", it.index)
+			return false
+		default:
+		}
+		retry, err := rs.post(it)
+		if err == nil {
+			return true
+		}
+		rs.Logger.Log("msg", "failed to send report to Hercules API", "index", it.index, "attempt", attempt+1, "error", err)
+		if !retry {
+			rs.metrics.reportsDropped.Inc(1)
+			return true
+		}
+		if attempt >= rs.MaxRetries {
+			rs.Logger.Log("msg", "giving up retrying report", "index", it.index)
+			return false
+		}
+		select {
+		case <-rs.canceled:
+			rs.Logger.Log("msg", "retrying report canceled on stop", "index", it.index)
+			return false
+		case <-time.After(backoff):
+		}
+		rs.metrics.adapterRequestRetry.Inc(1)
+		backoff *= 2
+	}
+}
+
+type batch struct {
+	ReportStorage *ReportStorage
+	Items         []item
+}
+
+func (b *batch) Add(i interface{}) {
+	b.Items = append(b.Items, i.(item))
+}
+
+// Fire sends reports of a batch index by index, once a report fails to send after all retries or retries are canceled
+// on stop, it is passed to FailedReportStorage along with the reports left unsent, as they would most likely fail too
+func (b *batch) Fire(notifier muster.Notifier) {
+	defer notifier.Done()
+	rs := b.ReportStorage
+
+	items := byIndex(b.Items)
+	for i, it := range items {
+		if !rs.send(it) {
+			rs.fail(items[i:])
+			return
+		}
+	}
+}
+
+// byIndex groups items by index in order of first items of indices keeping order of items of an index
+func byIndex(items []item) []item {
+	var indices []string
+	groups := make(map[string][]item)
+	for _, it := range items {
+		if _, found := groups[it.index]; !found {
+			indices = append(indices, it.index)
+		}
+		groups[it.index] = append(groups[it.index], it)
+	}
+	grouped := make([]item, 0, len(items))
+	for _, index := range indices {
+		grouped = append(grouped, groups[index]...)
+	}
+	return grouped
+}
+
+// fail passes reports which are still worth sending to FailedReportStorage if there is one, otherwise they are dropped
+func (rs *ReportStorage) fail(items []item) {
+	rs.Logger.Log("msg", "giving up sending reports", "count", len(items))
+	var reports []frontreport.Reportable
+	for _, it := range items {
+		reports = append(reports, it.report)
+	}
+	if rs.FailedReportStorage != nil {
+		rs.FailedReportStorage.AddFailedReports(reports)
+		return
 	}
+	rs.metrics.reportsDropped.Inc(int64(len(reports)))
 }
@@ -0,0 +1,178 @@
+package hercules
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// fakeHercules remembers documents sent to every index and indices in order of requests,
+// it fails first requests with given status
+type fakeHercules struct {
+	mu        sync.Mutex
+	failures  int
+	status    int
+	requests  int
+	indices   []string
+	documents map[string][]map[string]interface{}
+}
+
+func (fh *fakeHercules) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	fh.requests++
+	fh.indices = append(fh.indices, strings.TrimPrefix(r.URL.Path, "/logs/"))
+	if r.Header.Get("Authorization") != "ELK secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if fh.failures > 0 {
+		fh.failures--
+		w.WriteHeader(fh.status)
+		return
+	}
+	var document map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&document); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	index := strings.TrimPrefix(r.URL.Path, "/logs/")
+	fh.documents[index] = append(fh.documents[index], document)
+}
+
+func stacktraceJSReport(service, message string) *frontreport.StacktraceJSReport {
+	report := &frontreport.StacktraceJSReport{Message: message}
+	report.Service = service
+	return report
+}
+
+// TestReportStorage tests that reports are sent in background and failed requests are retried
+func TestReportStorage(t *testing.T) {
+	Convey("Given Hercules storage", t, func() {
+		hercules := &fakeHercules{documents: make(map[string][]map[string]interface{})}
+		server := httptest.NewServer(hercules)
+		defer server.Close()
+
+		metricStorage := frontreporttest.NewMetricStorage()
+		rs := &ReportStorage{
+			HerculesEndpoint:     server.URL,
+			HerculesAPIKey:       "secret",
+			Index:                frontreport.IndexTemplate{Template: "{type}-report-{service}-{date}"},
+			MaxRetries:           2,
+			RetryBackoff:         time.Millisecond,
+			RequestTimeout:       time.Second,
+			MaxBatchSize:         10,
+			MaxConcurrentBatches: 1,
+			BatchTimeout:         time.Hour,
+			PendingWorkCapacity:  10,
+			Logger:               log.NewNopLogger(),
+			MetricStorage:        metricStorage,
+		}
+		So(rs.Start(), ShouldBeNil)
+		date := time.Now().UTC().Format("2006.01.02")
+
+		Convey("Reports are sent index by index a document per request on stop", func() {
+			rs.AddReport(stacktraceJSReport("billing", "a"))
+			rs.AddReport(stacktraceJSReport("", "c"))
+			rs.AddReport(stacktraceJSReport("billing", "b"))
+			So(rs.Stop(), ShouldBeNil)
+
+			So(hercules.requests, ShouldEqual, 3)
+			So(hercules.indices, ShouldResemble, []string{
+				"stacktracejs-report-billing-" + date,
+				"stacktracejs-report-billing-" + date,
+				"stacktracejs-report-" + date,
+			})
+			billing := hercules.documents["stacktracejs-report-billing-"+date]
+			So(billing, ShouldHaveLength, 2)
+			So(billing[0]["message"], ShouldEqual, "a")
+			So(billing[1]["message"], ShouldEqual, "b")
+			So(hercules.documents["stacktracejs-report-"+date], ShouldHaveLength, 1)
+		})
+
+		Convey("Requests failed due to overload are retried", func() {
+			hercules.failures, hercules.status = 2, http.StatusServiceUnavailable
+			rs.AddReport(stacktraceJSReport("billing", "a"))
+			So(rs.Stop(), ShouldBeNil)
+
+			So(hercules.requests, ShouldEqual, 3)
+			So(hercules.documents["stacktracejs-report-billing-"+date], ShouldHaveLength, 1)
+		})
+
+		Convey("Rejected reports are not retried", func() {
+			hercules.failures, hercules.status = 1, http.StatusBadRequest
+			rs.AddReport(stacktraceJSReport("billing", "a"))
+			So(rs.Stop(), ShouldBeNil)
+
+			So(hercules.requests, ShouldEqual, 1)
+			So(hercules.documents, ShouldBeEmpty)
+			So(metricStorage.Count("hercules.reports.dropped"), ShouldEqual, 1)
+		})
+
+		Convey("Retries are canceled if stop takes too long", func() {
+			defer func(timeout time.Duration) { stopTimeout = timeout }(stopTimeout)
+			stopTimeout = 10 * time.Millisecond
+			rs.RetryBackoff = time.Hour
+			hercules.failures, hercules.status = 1, http.StatusServiceUnavailable
+			rs.AddReport(stacktraceJSReport("billing", "a"))
+			rs.AddReport(stacktraceJSReport("billing", "b"))
+
+			stopped := make(chan error)
+			go func() { stopped <- rs.Stop() }()
+			select {
+			case err := <-stopped:
+				So(err, ShouldNotBeNil)
+			case <-time.After(5 * time.Second):
+				t.Fatal("stop waits for retry backoff")
+			}
+			So(hercules.requests, ShouldEqual, 1)
+			So(metricStorage.Count("hercules.reports.dropped"), ShouldEqual, 2)
+		})
+
+		Convey("A report which failed to send after all retries is passed to failed report storage with the reports left", func() {
+			failedStorage := &frontreporttest.MemoryStorage{}
+			rs.FailedReportStorage = failedStorage
+			hercules.failures, hercules.status = 3, http.StatusServiceUnavailable
+			rs.AddReport(stacktraceJSReport("billing", "a"))
+			rs.AddReport(stacktraceJSReport("", "b"))
+			rs.AddReport(stacktraceJSReport("billing", "c"))
+			So(rs.Stop(), ShouldBeNil)
+
+			var messages []string
+			for _, report := range failedStorage.Reports() {
+				messages = append(messages, report.(*frontreport.StacktraceJSReport).Message)
+			}
+			So(messages, ShouldResemble, []string{"a", "c", "b"})
+			So(hercules.requests, ShouldEqual, 3)
+			So(hercules.documents, ShouldBeEmpty)
+			So(metricStorage.Count("hercules.reports.dropped"), ShouldEqual, 0)
+		})
+
+		Convey("Sending reports at once returns the ones worth retrying", func() {
+			a, b, c := stacktraceJSReport("billing", "a"), stacktraceJSReport("billing", "b"), stacktraceJSReport("billing", "c")
+			hercules.failures, hercules.status = 1, http.StatusBadRequest
+			retry, err := rs.SendReports([]frontreport.Reportable{a, b})
+			So(err, ShouldBeNil)
+			So(retry, ShouldBeEmpty)
+
+			hercules.failures, hercules.status = 1, http.StatusTooManyRequests
+			retry, err = rs.SendReports([]frontreport.Reportable{c})
+			So(err, ShouldNotBeNil)
+			So(retry, ShouldResemble, []frontreport.Reportable{c})
+			So(rs.Stop(), ShouldBeNil)
+
+			So(hercules.documents["stacktracejs-report-billing-"+date], ShouldHaveLength, 1)
+			So(metricStorage.Count("hercules.reports.dropped"), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,165 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+	"unicode"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// batchResult tells client which reports of a batch were stored, results are in the same order as reports
+type batchResult struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []batchItemResult `json:"results"`
+	// storageFull is how many reports are rejected because storage is saturated
+	storageFull int
+	// rateLimited is how many reports are rejected by rate limits, retryAfter is the longest wait they were told
+	rateLimited int
+	retryAfter  time.Duration
+}
+
+type batchItemResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (br *batchResult) accept() {
+	br.Accepted++
+	br.Results = append(br.Results, batchItemResult{Status: "accepted"})
+}
+
+func (br *batchResult) reject(err error) {
+	br.Rejected++
+	if err == errStorageFull {
+		br.storageFull++
+	}
+	if rateLimited, ok := err.(rateLimitedError); ok {
+		br.rateLimited++
+		if rateLimited.retryAfter > br.retryAfter {
+			br.retryAfter = rateLimited.retryAfter
+		}
+	}
+	br.Results = append(br.Results, batchItemResult{Status: "rejected", Error: err.Error()})
+}
+
+// processReportBatch stores every report of a batch independently and returns per-report results,
+// a single report is processed like for non-batchable report types and gets no results
+func (h *Handler) processReportBatch(body io.Reader, reportType frontreport.ReportType, source reportSource) (*batchResult, error) {
+	items, isBatch, err := decodeBatch(body)
+	if err == errBodyTooLarge {
+		h.metrics.total[reportType.Name].Inc(1)
+		h.metrics.errors[reportType.Name].Inc(1)
+		return nil, err
+	}
+	if !isBatch {
+		h.metrics.total[reportType.Name].Inc(1)
+		if err != nil {
+			h.Logger.Log("msg", "cannot process JSON body", "report_type", reportType.Name, "error", err)
+			h.metrics.errors[reportType.Name].Inc(1)
+			return nil, err
+		}
+		return nil, h.processRawReport(items[0], reportType, source)
+	}
+
+	result := &batchResult{Results: make([]batchItemResult, 0, len(items)+1)}
+	for _, item := range items {
+		h.metrics.total[reportType.Name].Inc(1)
+		if err := h.processRawReport(item, reportType, source); err != nil {
+			result.reject(err)
+		} else {
+			result.accept()
+		}
+	}
+	if err != nil {
+		// the rest of the body after the last decoded report is broken and counts as one rejected report
+		h.Logger.Log("msg", "cannot process JSON body", "report_type", reportType.Name, "error", err)
+		h.metrics.total[reportType.Name].Inc(1)
+		h.metrics.errors[reportType.Name].Inc(1)
+		result.reject(err)
+	}
+	return result, nil
+}
+
+func (h *Handler) writeBatchResult(w http.ResponseWriter, result *batchResult, reportType frontreport.ReportType) {
+	status := http.StatusOK
+	if result.Accepted == 0 && result.Rejected > 0 {
+		status = http.StatusBadRequest
+		switch result.Rejected {
+		case result.storageFull:
+			h.setStorageFullRetryAfter(w)
+			status = h.StorageFullStatus
+		case result.rateLimited:
+			setRetryAfter(w, result.retryAfter)
+			status = http.StatusTooManyRequests
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		h.Logger.Log("msg", "cannot write batch result", "report_type", reportType.Name, "error", err)
+	}
+}
+
+func (h *Handler) processRawReport(item json.RawMessage, reportType frontreport.ReportType, source reportSource) error {
+	report := reportType.New()
+	if err := json.Unmarshal(item, report); err != nil {
+		h.Logger.Log("msg", "cannot process JSON body", "report_type", reportType.Name, "error", err)
+		h.metrics.errors[reportType.Name].Inc(1)
+		return err
+	}
+	return h.storeReport(report, reportType, source)
+}
+
+// decodeBatch splits body into separate reports, body can be a single JSON object,
+// a JSON array of objects or newline-delimited JSON objects;
+// it is a batch if it is an array or holds more than one object
+func decodeBatch(body io.Reader) ([]json.RawMessage, bool, error) {
+	reader := bufio.NewReader(body)
+	first, err := peekNonSpace(reader)
+	if err == io.EOF {
+		return nil, false, errors.New("empty body")
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	var items []json.RawMessage
+	dec := json.NewDecoder(reader)
+	if first == '[' {
+		if err := dec.Decode(&items); err != nil {
+			return nil, true, err
+		}
+		if err := ensureEOF(dec); err != nil {
+			return nil, true, err
+		}
+		return items, true, nil
+	}
+
+	for {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err == io.EOF {
+			break
+		} else if err != nil {
+			return items, len(items) > 1, err
+		}
+		items = append(items, item)
+	}
+	return items, len(items) > 1, nil
+}
+
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if !unicode.IsSpace(rune(b)) {
+			return b, reader.UnreadByte()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// TestReportBatch tests that every report of a batch is stored independently and gets its own result
+func TestReportBatch(t *testing.T) {
+	Convey("Given handler", t, func() {
+		storage := &frontreporttest.MemoryStorage{}
+		h, metricStorage := newHandler(storage)
+		So(h.Start(), ShouldBeNil)
+		defer h.Stop()
+
+		decode := func(body string) batchResult {
+			var result batchResult
+			So(json.Unmarshal([]byte(body), &result), ShouldBeNil)
+			return result
+		}
+
+		Convey("A JSON array with broken reports is partially stored", func() {
+			w := post(h, "/stacktracejs", "application/json", `[{"message":"a"},"broken",{"message":"b"}]`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+			result := decode(w.Body.String())
+			So(result.Accepted, ShouldEqual, 2)
+			So(result.Rejected, ShouldEqual, 1)
+			So(result.Results, ShouldHaveLength, 3)
+			So(result.Results[0].Status, ShouldEqual, "accepted")
+			So(result.Results[1].Status, ShouldEqual, "rejected")
+			So(result.Results[1].Error, ShouldNotBeEmpty)
+			So(result.Results[2].Status, ShouldEqual, "accepted")
+
+			So(storage.Reports(), ShouldHaveLength, 2)
+			So(metricStorage.Count("http.report_decoding.stacktracejs.total"), ShouldEqual, 3)
+			So(metricStorage.Count("http.report_decoding.stacktracejs.errors"), ShouldEqual, 1)
+		})
+
+		Convey("Newline-delimited reports with a broken tail are partially stored", func() {
+			w := post(h, "/stacktracejs", "application/json", "{\"message\":\"a\"}\n{\"message\":\"b\"}\n{\"message\":")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			result := decode(w.Body.String())
+			So(result.Accepted, ShouldEqual, 2)
+			So(result.Rejected, ShouldEqual, 1)
+			So(storage.Reports(), ShouldHaveLength, 2)
+			So(metricStorage.Count("http.report_decoding.stacktracejs.errors"), ShouldEqual, 1)
+		})
+
+		Convey("A batch without valid reports is rejected", func() {
+			w := post(h, "/stacktracejs", "application/json", `["a","b"]`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			result := decode(w.Body.String())
+			So(result.Accepted, ShouldEqual, 0)
+			So(result.Rejected, ShouldEqual, 2)
+			So(storage.Reports(), ShouldBeEmpty)
+			So(metricStorage.Count("http.report_decoding.stacktracejs.errors"), ShouldEqual, 2)
+		})
+
+		Convey("A single report gets no results", func() {
+			w := post(h, "/stacktracejs", "application/json", `{"message":"a"}`)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(w.Body.String(), ShouldBeEmpty)
+			So(storage.Reports(), ShouldHaveLength, 1)
+		})
+	})
+}
@@ -0,0 +1,37 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxFormMemory is how much of multipart form is kept in memory, the rest goes to temporary files
+const maxFormMemory = 1 << 20
+
+// reportBody returns JSON body of a report request. Browsers can't send application/json
+// with navigator.sendBeacon without CORS preflight, so reports also come as JSON in text/plain
+// or as JSON in "report" field of a form
+func reportBody(r *http.Request, contentType string) (io.Reader, error) {
+	switch contentType {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		var err error
+		if contentType == "multipart/form-data" {
+			err = r.ParseMultipartForm(maxFormMemory)
+		} else {
+			err = r.ParseForm()
+		}
+		if err != nil {
+			return nil, err
+		}
+		report := r.PostForm.Get("report")
+		if report == "" {
+			return nil, errors.New("no report field in form")
+		}
+		return strings.NewReader(report), nil
+	default:
+		// application/json, text/plain, application/csp-report and alike carry JSON as is
+		return r.Body, nil
+	}
+}
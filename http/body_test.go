@@ -0,0 +1,66 @@
+package http
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// TestReportBody tests that reports sent with navigator.sendBeacon are decoded from any body it can send
+func TestReportBody(t *testing.T) {
+	Convey("Given handler", t, func() {
+		storage := &frontreporttest.MemoryStorage{}
+		h, _ := newHandler(storage)
+		So(h.Start(), ShouldBeNil)
+		defer h.Stop()
+
+		message := func() string {
+			reports := storage.Reports()
+			So(reports, ShouldHaveLength, 1)
+			return reports[0].(*frontreport.StacktraceJSReport).Message
+		}
+
+		Convey("JSON as plain text", func() {
+			w := post(h, "/stacktracejs", "text/plain;charset=UTF-8", `{"message":"a"}`)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(message(), ShouldEqual, "a")
+		})
+
+		Convey("JSON in report field of URL-encoded form", func() {
+			w := post(h, "/stacktracejs", "application/x-www-form-urlencoded", url.Values{"report": {`{"message":"a"}`}}.Encode())
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(message(), ShouldEqual, "a")
+		})
+
+		Convey("JSON in report field of multipart form", func() {
+			body := &bytes.Buffer{}
+			form := multipart.NewWriter(body)
+			So(form.WriteField("report", `{"message":"a"}`), ShouldBeNil)
+			So(form.Close(), ShouldBeNil)
+			w := post(h, "/stacktracejs", form.FormDataContentType(), body.String())
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(message(), ShouldEqual, "a")
+		})
+
+		Convey("Form without report field", func() {
+			w := post(h, "/stacktracejs", "application/x-www-form-urlencoded", url.Values{"message": {"a"}}.Encode())
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(storage.Reports(), ShouldBeEmpty)
+		})
+
+		Convey("CSP report of its own content type", func() {
+			w := post(h, "/csp", "application/csp-report", `{"csp-report":{"document-uri":"https://example.com/","blocked-uri":"https://evil.example/x.js"}}`)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			reports := storage.Reports()
+			So(reports, ShouldHaveLength, 1)
+			So(reports[0].(*frontreport.CSPReport).Body.BlockedURI, ShouldEqual, "https://evil.example/x.js")
+		})
+	})
+}
@@ -11,5 +11,10 @@ func (h *Handler) addCORSHeaders(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", origin)
 	w.Header().Set("Vary", "Origin")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding")
+	// navigator.sendBeacon with text/plain or form bodies needs no credentials,
+	// they are allowed only to origins trusted explicitly, otherwise any site could send credentialed requests
+	if h.DomainWhitelist[origin] {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
 }
@@ -0,0 +1,46 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// TestCORS tests that credentials are allowed only to whitelisted origins
+func TestCORS(t *testing.T) {
+	Convey("Given handler", t, func() {
+		h, _ := newHandler(&frontreporttest.MemoryStorage{})
+		So(h.Start(), ShouldBeNil)
+		defer h.Stop()
+
+		preflight := func(origin string) http.Header {
+			r := httptest.NewRequest("OPTIONS", "/csp", nil)
+			r.Header.Set("Origin", origin)
+			w := httptest.NewRecorder()
+			h.handleRequest(w, r)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			return w.Header()
+		}
+
+		Convey("Any origin is allowed without credentials if there is no whitelist", func() {
+			header := preflight("https://evil.example")
+			So(header.Get("Access-Control-Allow-Origin"), ShouldEqual, "https://evil.example")
+			So(header.Get("Access-Control-Allow-Credentials"), ShouldBeEmpty)
+		})
+
+		Convey("Whitelisted origins are allowed with credentials", func() {
+			h.DomainWhitelist = map[string]bool{"https://example.com": true}
+			header := preflight("https://example.com")
+			So(header.Get("Access-Control-Allow-Origin"), ShouldEqual, "https://example.com")
+			So(header.Get("Access-Control-Allow-Credentials"), ShouldEqual, "true")
+
+			header = preflight("https://evil.example")
+			So(header.Get("Access-Control-Allow-Origin"), ShouldBeEmpty)
+			So(header.Get("Access-Control-Allow-Credentials"), ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,44 @@
+package http
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// decompressBody wraps body into a reader decompressing it according to Content-Encoding
+func decompressBody(body io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return newDeflateReader(body)
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(body)), nil
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
+// newDeflateReader reads "deflate" encoding, which is zlib format as per RFC 7230,
+// though some clients send raw deflate stream without zlib header
+func newDeflateReader(body io.Reader) (io.ReadCloser, error) {
+	reader := bufio.NewReader(body)
+	header, err := reader.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(reader)
+	}
+	return flate.NewReader(reader), nil
+}
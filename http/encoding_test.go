@@ -0,0 +1,94 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+func compress(body string, newWriter func(io.Writer) io.WriteCloser) string {
+	compressed := &bytes.Buffer{}
+	w := newWriter(compressed)
+	So(w, ShouldNotBeNil)
+	_, err := io.WriteString(w, body)
+	So(err, ShouldBeNil)
+	So(w.Close(), ShouldBeNil)
+	return compressed.String()
+}
+
+var compressors = map[string]func(io.Writer) io.WriteCloser{
+	"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	"zlib": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+	"raw deflate": func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	},
+	"br": func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+}
+
+var contentEncodings = map[string]string{"gzip": "gzip", "zlib": "deflate", "raw deflate": "deflate", "br": "br"}
+
+// TestEncoding tests that compressed request bodies are decompressed within limits
+func TestEncoding(t *testing.T) {
+	Convey("Given handler", t, func() {
+		storage := &frontreporttest.MemoryStorage{}
+		h, metricStorage := newHandler(storage)
+		h.MaxDecompressedBodySize = 1000
+		So(h.Start(), ShouldBeNil)
+		defer h.Stop()
+
+		postEncoded := func(contentEncoding, body string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("POST", "/stacktracejs", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Content-Encoding", contentEncoding)
+			w := httptest.NewRecorder()
+			h.handleRequest(w, r)
+			return w
+		}
+
+		for name, newWriter := range compressors {
+			name, newWriter := name, newWriter
+			Convey("A report compressed with "+name+" is decompressed", func() {
+				w := postEncoded(contentEncodings[name], compress(`{"message":"a"}`, newWriter))
+				So(w.Code, ShouldEqual, http.StatusNoContent)
+				reports := storage.Reports()
+				So(reports, ShouldHaveLength, 1)
+				So(reports[0].(*frontreport.StacktraceJSReport).Message, ShouldEqual, "a")
+				So(metricStorage.Count("http.request_body.compressed_bytes"), ShouldEqual, 1)
+				So(metricStorage.Count("http.request_body.decompressed_bytes"), ShouldEqual, 1)
+			})
+		}
+
+		Convey("A compressed body over decompressed size limit is rejected", func() {
+			body := compress(`{"message":"`+strings.Repeat("x", 10000)+`"}`, compressors["gzip"])
+			So(len(body), ShouldBeLessThan, h.MaxBodySize)
+			w := postEncoded("gzip", body)
+			So(w.Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+			So(storage.Reports(), ShouldBeEmpty)
+			So(metricStorage.Count("http.report_decoding.stacktracejs.too_large"), ShouldEqual, 1)
+		})
+
+		Convey("Unknown encoding is not supported", func() {
+			w := postEncoded("compress", `{"message":"a"}`)
+			So(w.Code, ShouldEqual, http.StatusUnsupportedMediaType)
+			So(storage.Reports(), ShouldBeEmpty)
+		})
+
+		Convey("Broken compressed body is rejected", func() {
+			w := postEncoded("gzip", `{"message":"a"}`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
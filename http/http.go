@@ -14,17 +14,52 @@ import (
 
 // Handler processes incoming reports
 type Handler struct {
-	ReportStorage      frontreport.ReportStorage
-	SourcemapProcessor frontreport.SourcemapProcessor
-	Port               string
-	ServiceWhitelist   map[string]bool
-	DomainWhitelist    map[string]bool
-	Logger             frontreport.Logger
-	MetricStorage      frontreport.MetricStorage
-	tomb               tomb.Tomb
-	metrics            struct {
-		total  map[string]frontreport.MetricCounter
-		errors map[string]frontreport.MetricCounter
+	ReportStorage           frontreport.ReportStorage
+	Registry                *frontreport.ReportTypeRegistry
+	SourcemapProcessor      frontreport.SourcemapProcessor
+	Port                    string
+	RoutePrefixes           []string
+	RouteCompat             bool
+	MaxBodySize             int64
+	MaxDecompressedBodySize int64
+	MaxStackFrames          int
+	MaxFieldLength          int
+	ClientRateLimit         RateLimit
+	ServiceRateLimit        RateLimit
+	ServiceRateLimits       map[string]RateLimit
+	StackHashRateLimit      RateLimit
+	TrustForwardedFor       bool
+	ServiceWhitelist        map[string]bool
+	DomainWhitelist         map[string]bool
+	StorageFullStatus       int
+	StorageFullRetryAfter   time.Duration
+	Logger                  frontreport.Logger
+	MetricStorage           frontreport.MetricStorage
+	router                  *router
+	rateLimiters            struct {
+		client    *rateLimiter
+		service   *rateLimiter
+		stackHash *rateLimiter
+	}
+	tomb    tomb.Tomb
+	metrics struct {
+		total       map[string]frontreport.MetricCounter
+		errors      map[string]frontreport.MetricCounter
+		tooLarge    map[string]frontreport.MetricCounter
+		truncated   map[string]frontreport.MetricCounter
+		storageFull map[string]frontreport.MetricCounter
+
+		compressedBytes   frontreport.MetricHistogram
+		decompressedBytes frontreport.MetricHistogram
+		rateLimited       struct {
+			client    frontreport.MetricCounter
+			service   frontreport.MetricCounter
+			stackHash frontreport.MetricCounter
+		}
+		nel struct {
+			phases map[string]frontreport.MetricCounter
+			types  map[string]frontreport.MetricCounter
+		}
 	}
 }
 
@@ -32,10 +67,30 @@ type Handler struct {
 func (h *Handler) Start() error {
 	h.metrics.total = make(map[string]frontreport.MetricCounter)
 	h.metrics.errors = make(map[string]frontreport.MetricCounter)
-	for _, reportType := range []string{"csp", "pkp", "stacktracejs"} {
-		h.metrics.total[reportType] = h.MetricStorage.RegisterCounter(fmt.Sprintf("http.report_decoding.%s.total", reportType))
-		h.metrics.errors[reportType] = h.MetricStorage.RegisterCounter(fmt.Sprintf("http.report_decoding.%s.errors", reportType))
+	h.metrics.tooLarge = make(map[string]frontreport.MetricCounter)
+	h.metrics.truncated = make(map[string]frontreport.MetricCounter)
+	h.metrics.storageFull = make(map[string]frontreport.MetricCounter)
+	if h.Registry == nil {
+		h.Registry = frontreport.DefaultRegistry
+	}
+	for _, reportType := range h.Registry.Types() {
+		h.metrics.total[reportType.Name] = h.MetricStorage.RegisterCounter(fmt.Sprintf("http.report_decoding.%s.total", reportType.Name))
+		h.metrics.errors[reportType.Name] = h.MetricStorage.RegisterCounter(fmt.Sprintf("http.report_decoding.%s.errors", reportType.Name))
+		h.metrics.tooLarge[reportType.Name] = h.MetricStorage.RegisterCounter(fmt.Sprintf("http.report_decoding.%s.too_large", reportType.Name))
+		h.metrics.truncated[reportType.Name] = h.MetricStorage.RegisterCounter(fmt.Sprintf("http.report_decoding.%s.truncated", reportType.Name))
+		h.metrics.storageFull[reportType.Name] = h.MetricStorage.RegisterCounter(fmt.Sprintf("http.report_decoding.%s.storage_full", reportType.Name))
 	}
+	h.registerNELMetrics()
+	h.metrics.compressedBytes = h.MetricStorage.RegisterHistogram("http.request_body.compressed_bytes")
+	h.metrics.decompressedBytes = h.MetricStorage.RegisterHistogram("http.request_body.decompressed_bytes")
+	h.metrics.rateLimited.client = h.MetricStorage.RegisterCounter("http.rate_limit.client.rejected")
+	h.metrics.rateLimited.service = h.MetricStorage.RegisterCounter("http.rate_limit.service.rejected")
+	h.metrics.rateLimited.stackHash = h.MetricStorage.RegisterCounter("http.rate_limit.stackhash.rejected")
+
+	h.router = newRouter(h.Registry, h.RoutePrefixes, h.RouteCompat)
+	h.rateLimiters.client = newRateLimiter(h.ClientRateLimit, nil)
+	h.rateLimiters.service = newRateLimiter(h.ServiceRateLimit, h.ServiceRateLimits)
+	h.rateLimiters.stackHash = newRateLimiter(h.StackHashRateLimit, nil)
 
 	server := &graceful.Server{
 		Timeout:          10 * time.Second,
@@ -0,0 +1,134 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"unicode/utf8"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// truncationMarker is appended to strings cut to MaxFieldLength
+const truncationMarker = "...[truncated]"
+
+var (
+	errBodyTooLarge = errors.New("request body too large")
+	errTrailingData = errors.New("unexpected data after JSON body")
+)
+
+// limitedBody counts bytes read, fails reading after limit is exceeded and remembers it,
+// so that the reason is known however decoders wrap the error; zero limit means no limit
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.limit > 0 {
+		if lb.read > lb.limit {
+			lb.exceeded = true
+			return 0, errBodyTooLarge
+		}
+		// read one byte more than allowed to tell exact limit from exceeding it
+		if rest := lb.limit - lb.read + 1; int64(len(p)) > rest {
+			p = p[:rest]
+		}
+	}
+	n, err := lb.ReadCloser.Read(p)
+	lb.read += int64(n)
+	if lb.limit > 0 && lb.read > lb.limit {
+		lb.exceeded = true
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// ensureEOF rejects anything but whitespace after decoded JSON value
+func ensureEOF(dec *json.Decoder) error {
+	if _, err := dec.Token(); err != io.EOF {
+		if err == errBodyTooLarge {
+			return err
+		}
+		return errTrailingData
+	}
+	return nil
+}
+
+// limitReport cuts long stacks and strings of a decoded report, it returns true if anything was cut
+// and how many stack frames were cut, a stack is cut to MaxStackFrames-1 frames to leave room for a marker
+// frame which is added after sourcemaps are applied, see truncatedFrames
+func (h *Handler) limitReport(report frontreport.Reportable) (bool, int) {
+	truncated, omittedFrames := false, 0
+	if stackReport, ok := report.(frontreport.StackReport); ok && h.MaxStackFrames > 0 {
+		stack := stackReport.GetStack()
+		if len(stack) > h.MaxStackFrames {
+			omittedFrames = len(stack) - h.MaxStackFrames + 1
+			stackReport.SetStack(stack[: h.MaxStackFrames-1 : h.MaxStackFrames-1])
+			truncated = true
+		}
+	}
+	if h.MaxFieldLength > 0 {
+		if truncateStrings(reflect.ValueOf(report), h.MaxFieldLength) {
+			truncated = true
+		}
+	}
+	return truncated, omittedFrames
+}
+
+// truncatedFrames is a stack frame telling how many frames were cut from the end of a stack
+func truncatedFrames(omittedFrames int) frontreport.StacktraceJSStackframe {
+	return frontreport.StacktraceJSStackframe{FunctionName: fmt.Sprintf("[%d more frames truncated]", omittedFrames)}
+}
+
+// truncateStrings walks exported fields, slices and maps cutting strings longer than max
+func truncateStrings(v reflect.Value, max int) bool {
+	truncated := false
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			truncated = truncateStrings(v.Elem(), max)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() && truncateStrings(v.Field(i), max) {
+				truncated = true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if truncateStrings(v.Index(i), max) {
+				truncated = true
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			value := v.MapIndex(key)
+			if value.Kind() == reflect.String {
+				if value.Len() > max {
+					v.SetMapIndex(key, reflect.ValueOf(truncateString(value.String(), max)).Convert(value.Type()))
+					truncated = true
+				}
+			} else if truncateStrings(value, max) {
+				truncated = true
+			}
+		}
+	case reflect.String:
+		if v.CanSet() && v.Len() > max {
+			v.SetString(truncateString(v.String(), max))
+			truncated = true
+		}
+	}
+	return truncated
+}
+
+func truncateString(s string, max int) string {
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max] + truncationMarker
+}
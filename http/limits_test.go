@@ -0,0 +1,66 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// TestLimits tests that large requests are rejected and long reports are cut
+func TestLimits(t *testing.T) {
+	Convey("Given handler with small limits", t, func() {
+		storage := &frontreporttest.MemoryStorage{}
+		h, metricStorage := newHandler(storage)
+		h.MaxBodySize = 100
+		h.MaxStackFrames = 3
+		h.MaxFieldLength = 10
+		So(h.Start(), ShouldBeNil)
+		defer h.Stop()
+
+		Convey("A body over the limit is rejected", func() {
+			w := post(h, "/stacktracejs", "application/json", `{"message":"`+strings.Repeat("x", 100)+`"}`)
+			So(w.Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+			So(storage.Reports(), ShouldBeEmpty)
+			So(metricStorage.Count("http.report_decoding.stacktracejs.too_large"), ShouldEqual, 1)
+		})
+
+		Convey("A body of exactly the limit is accepted", func() {
+			body := `{"message":"` + strings.Repeat("x", 86) + `"}`
+			So(body, ShouldHaveLength, 100)
+			w := post(h, "/stacktracejs", "application/json", body)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(metricStorage.Count("http.report_decoding.stacktracejs.too_large"), ShouldEqual, 0)
+		})
+
+		Convey("Data after JSON body is rejected", func() {
+			w := post(h, "/csp", "application/csp-report", `{"csp-report":{}} garbage`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(storage.Reports(), ShouldBeEmpty)
+		})
+
+		Convey("Long strings and stacks are cut", func() {
+			h.MaxBodySize = 1 << 20
+			var frames []string
+			for i := 0; i < 5; i++ {
+				frames = append(frames, fmt.Sprintf(`{"functionName":"f%d"}`, i))
+			}
+			w := post(h, "/stacktracejs", "application/json", `{"message":"0123456789abc","stack":[`+strings.Join(frames, ",")+`]}`)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+
+			reports := storage.Reports()
+			So(reports, ShouldHaveLength, 1)
+			report := reports[0].(*frontreport.StacktraceJSReport)
+			So(report.Message, ShouldEqual, "0123456789"+truncationMarker)
+			So(report.Stack, ShouldHaveLength, 3)
+			So(report.Stack[1].FunctionName, ShouldEqual, "f1")
+			So(report.Stack[2].FunctionName, ShouldEqual, "[3 more frames truncated]")
+			So(metricStorage.Count("http.report_decoding.stacktracejs.truncated"), ShouldEqual, 1)
+		})
+	})
+}
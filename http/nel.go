@@ -0,0 +1,51 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// nelPhases and nelTypes are NEL report phases and error types as per https://w3c.github.io/network-error-logging/#predefined-network-error-types,
+// anything else is counted as "other"
+var (
+	nelPhases = []string{"dns", "connection", "application"}
+	nelTypes  = []string{
+		"ok",
+		"dns.unreachable", "dns.name_not_resolved", "dns.failed", "dns.address_changed",
+		"tcp.timed_out", "tcp.closed", "tcp.reset", "tcp.refused", "tcp.aborted",
+		"tcp.address_invalid", "tcp.address_unreachable", "tcp.failed",
+		"tls.version_or_cipher_mismatch", "tls.bad_client_auth_cert", "tls.cert.name_invalid",
+		"tls.cert.date_invalid", "tls.cert.authority_invalid", "tls.cert.invalid", "tls.cert.revoked",
+		"tls.cert.pinned_key_not_in_cert_list", "tls.protocol.error", "tls.failed",
+		"http.error", "http.protocol.error", "http.response.invalid", "http.response.redirect_loop", "http.failed",
+		"abandoned", "unknown",
+	}
+)
+
+func (h *Handler) registerNELMetrics() {
+	h.metrics.nel.phases = make(map[string]frontreport.MetricCounter)
+	h.metrics.nel.types = make(map[string]frontreport.MetricCounter)
+	for _, phase := range append(nelPhases, "other") {
+		h.metrics.nel.phases[phase] = h.MetricStorage.RegisterCounter(fmt.Sprintf("http.report_decoding.nel.phase.%s", phase))
+	}
+	for _, nelType := range append(nelTypes, "other") {
+		// NEL types are dot-separated, which would produce nested Graphite metrics
+		metricName := strings.Replace(nelType, ".", "_", -1)
+		h.metrics.nel.types[nelType] = h.MetricStorage.RegisterCounter(fmt.Sprintf("http.report_decoding.nel.type.%s", metricName))
+	}
+}
+
+func (h *Handler) countNELReport(report *frontreport.NELReport) {
+	if counter, ok := h.metrics.nel.phases[report.Body.Phase]; ok {
+		counter.Inc(1)
+	} else {
+		h.metrics.nel.phases["other"].Inc(1)
+	}
+	if counter, ok := h.metrics.nel.types[report.Body.Type]; ok {
+		counter.Inc(1)
+	} else {
+		h.metrics.nel.types["other"].Inc(1)
+	}
+}
@@ -0,0 +1,161 @@
+package http
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// RateLimit allows Rate events per second on average and up to Burst events at once, zero Rate means no limit
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit parses limit in "rate:burst" format, e.g. "10:50", burst defaults to rate rounded up
+func ParseRateLimit(s string) (RateLimit, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate < 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate in rate limit %q", s)
+	}
+	limit := RateLimit{Rate: rate, Burst: int(math.Ceil(rate))}
+	if len(parts) == 2 {
+		if limit.Burst, err = strconv.Atoi(parts[1]); err != nil || limit.Burst < 1 {
+			return RateLimit{}, fmt.Errorf("invalid burst in rate limit %q", s)
+		}
+	}
+	return limit, nil
+}
+
+// rateLimitedError tells client when it is worth trying again
+type rateLimitedError struct {
+	retryAfter time.Duration
+}
+
+func (err rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry after %s", err.retryAfter)
+}
+
+// rateLimiter keeps a token bucket per key, buckets that have been idle long enough to refill are forgotten
+type rateLimiter struct {
+	limit     RateLimit
+	overrides map[string]RateLimit
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+const rateLimiterSweepInterval = time.Minute
+
+func newRateLimiter(limit RateLimit, overrides map[string]RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:     limit,
+		overrides: overrides,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from key bucket, limit override is looked up by overrideKey;
+// if there are no tokens left, it returns time until next token
+func (rl *rateLimiter) allow(key, overrideKey string) (bool, time.Duration) {
+	limit := rl.limit
+	if override, ok := rl.overrides[overrideKey]; ok {
+		limit = override
+	}
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) > rateLimiterSweepInterval {
+		for k, b := range rl.buckets {
+			if b.refill(now) >= float64(b.limit.Burst) {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		rl.buckets[key] = b
+	}
+	if b.refill(now) < 1 {
+		return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (b *bucket) refill(now time.Time) float64 {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+	return b.tokens
+}
+
+// clientIP returns address of the client, X-Forwarded-For is used only if frontreport is behind a trusted proxy
+func (h *Handler) clientIP(r *http.Request) string {
+	if h.TrustForwardedFor {
+		// client controls every entry but the last one, which is appended by the proxy in front of us
+		if values := r.Header["X-Forwarded-For"]; len(values) > 0 {
+			entries := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// stackHashReport is a report carrying client-side hash of its stacktrace
+type stackHashReport interface {
+	GetStackHash() string
+}
+
+// checkRateLimits takes tokens for report service and stacktrace, so that a single broken page can't flood storage
+func (h *Handler) checkRateLimits(report frontreport.Reportable) error {
+	service := report.GetService()
+	if ok, retryAfter := h.rateLimiters.service.allow(service, service); !ok {
+		h.metrics.rateLimited.service.Inc(1)
+		return rateLimitedError{retryAfter: retryAfter}
+	}
+	if hashed, ok := report.(stackHashReport); ok && hashed.GetStackHash() != "" {
+		if ok, retryAfter := h.rateLimiters.stackHash.allow(service+"/"+hashed.GetStackHash(), ""); !ok {
+			h.metrics.rateLimited.stackHash.Inc(1)
+			return rateLimitedError{retryAfter: retryAfter}
+		}
+	}
+	return nil
+}
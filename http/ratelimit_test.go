@@ -0,0 +1,143 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// TestRateLimits tests that clients, services and stacktraces over their limits are told to retry later
+func TestRateLimits(t *testing.T) {
+	Convey("Given handler with rate limits", t, func() {
+		storage := &frontreporttest.MemoryStorage{}
+		h, metricStorage := newHandler(storage)
+		h.ClientRateLimit = RateLimit{Rate: 0.5, Burst: 2}
+		h.ServiceRateLimit = RateLimit{Rate: 0.5, Burst: 1}
+		h.ServiceRateLimits = map[string]RateLimit{"billing": {Rate: 0.5, Burst: 3}}
+		h.StackHashRateLimit = RateLimit{Rate: 0.5, Burst: 1}
+		So(h.Start(), ShouldBeNil)
+		defer h.Stop()
+
+		postFrom := func(remoteAddr, forwardedFor, body string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("POST", "/stacktracejs", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			r.RemoteAddr = remoteAddr
+			if forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", forwardedFor)
+			}
+			w := httptest.NewRecorder()
+			h.handleRequest(w, r)
+			return w
+		}
+
+		Convey("Requests of a client over its limit are rejected", func() {
+			So(postFrom("10.0.0.1:1000", "", `{"service":"billing"}`).Code, ShouldEqual, http.StatusNoContent)
+			So(postFrom("10.0.0.1:1001", "", `{"service":"billing"}`).Code, ShouldEqual, http.StatusNoContent)
+			w := postFrom("10.0.0.1:1002", "", `{"service":"billing"}`)
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "2")
+			So(metricStorage.Count("http.rate_limit.client.rejected"), ShouldEqual, 1)
+
+			So(postFrom("10.0.0.2:1000", "", `{"service":"billing"}`).Code, ShouldEqual, http.StatusNoContent)
+			So(storage.Reports(), ShouldHaveLength, 3)
+		})
+
+		Convey("X-Forwarded-For tells clients apart only behind a trusted proxy", func() {
+			h.rateLimiters.service = newRateLimiter(RateLimit{}, nil)
+
+			So(postFrom("10.0.0.1:1000", "192.0.2.1", `{"service":"billing"}`).Code, ShouldEqual, http.StatusNoContent)
+			So(postFrom("10.0.0.1:1000", "192.0.2.2", `{"service":"billing"}`).Code, ShouldEqual, http.StatusNoContent)
+			So(postFrom("10.0.0.1:1000", "192.0.2.3", `{"service":"billing"}`).Code, ShouldEqual, http.StatusTooManyRequests)
+
+			h.TrustForwardedFor = true
+			So(postFrom("10.0.0.1:1000", "192.0.2.3", `{"service":"billing"}`).Code, ShouldEqual, http.StatusNoContent)
+			So(postFrom("10.0.0.1:1000", "192.0.2.4", `{"service":"billing"}`).Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("Only the X-Forwarded-For entry appended by the proxy is trusted", func() {
+			h.rateLimiters.service = newRateLimiter(RateLimit{}, nil)
+			h.TrustForwardedFor = true
+
+			So(postFrom("10.0.0.1:1000", "198.51.100.1, 192.0.2.1", `{"service":"billing"}`).Code, ShouldEqual, http.StatusNoContent)
+			So(postFrom("10.0.0.1:1000", "198.51.100.2, 192.0.2.1", `{"service":"billing"}`).Code, ShouldEqual, http.StatusNoContent)
+			So(postFrom("10.0.0.1:1000", "198.51.100.3,192.0.2.1", `{"service":"billing"}`).Code, ShouldEqual, http.StatusTooManyRequests)
+			So(postFrom("10.0.0.1:1000", "192.0.2.1, 192.0.2.2", `{"service":"billing"}`).Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("Services have their own limits", func() {
+			h.rateLimiters.client = newRateLimiter(RateLimit{}, nil)
+
+			So(postFrom("10.0.0.1:1000", "", `{"service":"shop"}`).Code, ShouldEqual, http.StatusNoContent)
+			So(postFrom("10.0.0.1:1000", "", `{"service":"shop"}`).Code, ShouldEqual, http.StatusTooManyRequests)
+			for i := 0; i < 3; i++ {
+				So(postFrom("10.0.0.1:1000", "", `{"service":"Billing"}`).Code, ShouldEqual, http.StatusNoContent)
+			}
+			So(postFrom("10.0.0.1:1000", "", `{"service":"billing"}`).Code, ShouldEqual, http.StatusTooManyRequests)
+			So(metricStorage.Count("http.rate_limit.service.rejected"), ShouldEqual, 2)
+		})
+
+		Convey("The same stacktrace of a service is limited", func() {
+			h.rateLimiters.client = newRateLimiter(RateLimit{}, nil)
+
+			So(postFrom("10.0.0.1:1000", "", `{"service":"billing","stackHash":"a"}`).Code, ShouldEqual, http.StatusNoContent)
+			So(postFrom("10.0.0.1:1000", "", `{"service":"billing","stackHash":"b"}`).Code, ShouldEqual, http.StatusNoContent)
+			w := postFrom("10.0.0.1:1000", "", `{"service":"billing","stackHash":"a"}`)
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("Retry-After"), ShouldNotBeEmpty)
+			So(metricStorage.Count("http.rate_limit.stackhash.rejected"), ShouldEqual, 1)
+			So(storage.Reports(), ShouldHaveLength, 2)
+		})
+
+		Convey("A batch with every report over its limit is told to retry later", func() {
+			h.rateLimiters.client = newRateLimiter(RateLimit{}, nil)
+
+			w := postFrom("10.0.0.1:1000", "", `[{"service":"billing","stackHash":"a"},{"service":"billing","stackHash":"a"}]`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			w = postFrom("10.0.0.1:1000", "", `[{"service":"billing","stackHash":"a"},{"service":"billing","stackHash":"a"}]`)
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "2")
+			So(w.Body.String(), ShouldContainSubstring, `"rejected":2`)
+
+			w = postFrom("10.0.0.1:1000", "", `[{"service":"billing","stackHash":"a"},"broken"]`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Header().Get("Retry-After"), ShouldBeEmpty)
+			So(storage.Reports(), ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("Rate limiter forgets refilled buckets", t, func() {
+		rl := newRateLimiter(RateLimit{Rate: 1, Burst: 2}, nil)
+		ok, _ := rl.allow("a", "")
+		So(ok, ShouldBeTrue)
+		ok, _ = rl.allow("b", "")
+		So(ok, ShouldBeTrue)
+		So(rl.buckets, ShouldHaveLength, 2)
+
+		rl.buckets["a"].last = time.Now().Add(-time.Hour)
+		rl.lastSweep = time.Now().Add(-2 * rateLimiterSweepInterval)
+		ok, _ = rl.allow("c", "")
+		So(ok, ShouldBeTrue)
+		So(rl.buckets, ShouldContainKey, "b")
+		So(rl.buckets, ShouldContainKey, "c")
+		So(rl.buckets, ShouldNotContainKey, "a")
+	})
+
+	Convey("Rate limits are parsed", t, func() {
+		limit, err := ParseRateLimit("10:50")
+		So(err, ShouldBeNil)
+		So(limit, ShouldResemble, RateLimit{Rate: 10, Burst: 50})
+		limit, err = ParseRateLimit("0.5")
+		So(err, ShouldBeNil)
+		So(limit, ShouldResemble, RateLimit{Rate: 0.5, Burst: 1})
+		for _, s := range []string{"x", "-1", "1:0", "1:x"} {
+			_, err := ParseRateLimit(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -4,63 +4,260 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"math"
+	"mime"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/skbkontur/frontreport"
 )
 
+// errStorageFull means that storage is saturated and a report is refused instead of blocking the request
+var errStorageFull = errors.New("storage is full")
+
 func (h *Handler) handleReport(w http.ResponseWriter, r *http.Request) {
-	switch {
-	case strings.Contains(r.URL.Path, "csp"):
-		report := &frontreport.CSPReport{}
-		if err := h.processReport(r.Body, report, r.Host); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-	case strings.Contains(r.URL.Path, "pkp"):
-		report := &frontreport.PKPReport{}
-		if err := h.processReport(r.Body, report, r.Host); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	reportType, ok := h.router.route(r.URL.Path, contentType)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if ok, retryAfter := h.rateLimiters.client.allow(h.clientIP(r), ""); !ok {
+		h.metrics.rateLimited.client.Inc(1)
+		writeRateLimited(w, retryAfter)
+		return
+	}
+
+	limited := &limitedBody{ReadCloser: r.Body, limit: h.MaxBodySize}
+	decompressed := &limitedBody{}
+	r.Body = limited
+
+	source := reportSource{host: r.Host, service: r.URL.Query().Get("service")}
+	var result *batchResult
+	var body io.Reader
+	var err error
+	if contentEncoding := r.Header.Get("Content-Encoding"); contentEncoding != "" && contentEncoding != "identity" {
+		var decompressor io.ReadCloser
+		if decompressor, err = decompressBody(limited, contentEncoding); err == nil {
+			decompressed = &limitedBody{ReadCloser: decompressor, limit: h.MaxDecompressedBodySize}
+			r.Body = decompressed
+			defer func() {
+				h.metrics.compressedBytes.Update(limited.read)
+				h.metrics.decompressedBytes.Update(decompressed.read)
+			}()
 		}
-	case strings.Contains(r.URL.Path, "stacktracejs"):
-		report := &frontreport.StacktraceJSReport{}
-		if err := h.processReport(r.Body, report, r.Host); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	}
+	if err == nil {
+		body, err = reportBody(r, contentType)
+	}
+	if err != nil {
+		h.Logger.Log(
+			"msg", "cannot read report from request",
+			"report_type", reportType.Name,
+			"content_type", contentType,
+			"content_encoding", r.Header.Get("Content-Encoding"),
+			"error", err)
+		h.metrics.total[reportType.Name].Inc(1)
+		h.metrics.errors[reportType.Name].Inc(1)
+	} else {
+		switch {
+		case reportType.ReportingAPIBatch:
+			err = h.processReportingAPIBatch(body, reportType, source)
+		case reportType.Batchable:
+			result, err = h.processReportBatch(body, reportType, source)
+		default:
+			err = h.processReport(body, reportType, source)
 		}
+	}
+
+	rateLimited, isRateLimited := err.(rateLimitedError)
+	switch {
+	case limited.exceeded:
+		h.Logger.Log("msg", "request body too large", "report_type", reportType.Name, "limit", h.MaxBodySize)
+		h.metrics.tooLarge[reportType.Name].Inc(1)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case decompressed.exceeded:
+		h.Logger.Log("msg", "decompressed request body too large", "report_type", reportType.Name, "limit", h.MaxDecompressedBodySize)
+		h.metrics.tooLarge[reportType.Name].Inc(1)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case isRateLimited:
+		writeRateLimited(w, rateLimited.retryAfter)
+	case err == errStorageFull:
+		h.writeStorageFull(w)
+	case err == errUnsupportedEncoding:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+	case result != nil:
+		h.writeBatchResult(w, result, reportType)
 	default:
-		w.WriteHeader(http.StatusNotFound)
-		return
+		w.WriteHeader(http.StatusNoContent)
 	}
+}
 
-	w.WriteHeader(http.StatusNoContent)
+// reportSource describes request a report came with: host it was sent to
+// and service from "service" URL query parameter for reports which do not tell their service
+type reportSource struct {
+	host    string
+	service string
 }
 
-func (h *Handler) processReport(body io.Reader, report frontreport.Reportable, host string) error {
-	h.metrics.total[report.GetType()].Inc(1)
+func (h *Handler) processReport(body io.Reader, reportType frontreport.ReportType, source reportSource) error {
+	h.metrics.total[reportType.Name].Inc(1)
 
+	report := reportType.New()
 	dec := json.NewDecoder(body)
-	if err := dec.Decode(report); err != nil {
-		h.Logger.Log("msg", "cannot process JSON body", "report_type", report.GetType(), "error", err)
-		h.metrics.errors[report.GetType()].Inc(1)
+	err := dec.Decode(report)
+	if err == nil {
+		err = ensureEOF(dec)
+	}
+	if err != nil {
+		h.Logger.Log("msg", "cannot process JSON body", "report_type", reportType.Name, "error", err)
+		h.metrics.errors[reportType.Name].Inc(1)
 		return err
 	}
+	return h.storeReport(report, reportType, source)
+}
+
+// errNoValidReports means that none of Reporting API batch entries could be stored
+var errNoValidReports = errors.New("no valid reports in batch")
+
+// processReportingAPIBatch splits W3C Reporting API batch into separate reports,
+// a broken or unknown entry does not prevent the rest of the batch from being stored,
+// but a batch without a single stored report is refused
+func (h *Handler) processReportingAPIBatch(body io.Reader, batchType frontreport.ReportType, source reportSource) error {
+	h.metrics.total[batchType.Name].Inc(1)
+
+	var entries []json.RawMessage
+	dec := json.NewDecoder(body)
+	err := dec.Decode(&entries)
+	if err == nil {
+		err = ensureEOF(dec)
+	}
+	if err != nil {
+		h.Logger.Log("msg", "cannot process JSON body", "report_type", batchType.Name, "error", err)
+		h.metrics.errors[batchType.Name].Inc(1)
+		return err
+	}
+
+	stored, refused, failed := 0, 0, 0
+	var rateLimited error
+	for _, entry := range entries {
+		var envelope struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(entry, &envelope); err != nil {
+			h.Logger.Log("msg", "cannot process Reporting API entry", "report_type", batchType.Name, "error", err)
+			h.metrics.errors[batchType.Name].Inc(1)
+			failed++
+			continue
+		}
+
+		reportType, ok := h.Registry.LookupReportingAPIType(envelope.Type)
+		if !ok {
+			h.Logger.Log("msg", "unsupported Reporting API report type", "report_type", batchType.Name, "type", envelope.Type)
+			h.metrics.errors[batchType.Name].Inc(1)
+			failed++
+			continue
+		}
+
+		h.metrics.total[reportType.Name].Inc(1)
+		report := reportType.New()
+		if err := json.Unmarshal(entry, report); err != nil {
+			h.Logger.Log("msg", "cannot process Reporting API entry", "report_type", reportType.Name, "error", err)
+			h.metrics.errors[reportType.Name].Inc(1)
+			failed++
+			continue
+		}
+		err := h.storeReport(report, reportType, source)
+		switch err.(type) {
+		case nil:
+			stored++
+			if nelReport, ok := report.(*frontreport.NELReport); ok {
+				h.countNELReport(nelReport)
+			}
+		case rateLimitedError:
+			rateLimited = err
+		default:
+			if err == errStorageFull {
+				refused++
+			} else {
+				failed++
+			}
+		}
+	}
+
+	// let browser deliver the batch again later, unless some of its reports have been stored already
+	switch {
+	case stored > 0:
+		return nil
+	case refused > 0:
+		return errStorageFull
+	case rateLimited != nil:
+		return rateLimited
+	case failed > 0:
+		return errNoValidReports
+	}
+	return nil
+}
+
+func (h *Handler) storeReport(report frontreport.Reportable, reportType frontreport.ReportType, source reportSource) error {
+	if serviceReport, ok := report.(frontreport.ServiceReport); ok && report.GetService() == "" && source.service != "" {
+		serviceReport.SetService(source.service)
+	}
+	truncated, omittedFrames := h.limitReport(report)
+	if truncated {
+		h.metrics.truncated[reportType.Name].Inc(1)
+	}
+	for _, validate := range reportType.Validators {
+		if err := validate(report); err != nil {
+			h.Logger.Log("msg", "report is not valid", "report_type", reportType.Name, "error", err)
+			h.metrics.errors[reportType.Name].Inc(1)
+			return err
+		}
+	}
 	if len(h.ServiceWhitelist) > 0 && !h.ServiceWhitelist[report.GetService()] {
-		h.Logger.Log("msg", "service not in whitelist", "service", report.GetService(), "report_type", report.GetType())
-		h.metrics.errors[report.GetType()].Inc(1)
+		h.Logger.Log("msg", "service not in whitelist", "service", report.GetService(), "report_type", reportType.Name)
+		h.metrics.errors[reportType.Name].Inc(1)
 		return errors.New("service not in whitelist")
 	}
-	report.SetTimestamp(time.Now().UTC().Format("2006-01-02T15:04:05.999Z"))
-	report.SetHost(host)
+	if err := h.checkRateLimits(report); err != nil {
+		return err
+	}
+	report.SetTimestamp(time.Now().UTC().Format(frontreport.TimestampFormat))
+	report.SetHost(source.host)
 
-	switch report.(type) {
-	case *frontreport.StacktraceJSReport:
-		report.(*frontreport.StacktraceJSReport).Stack = h.SourcemapProcessor.ProcessStack(report.(*frontreport.StacktraceJSReport).Stack)
+	if stackReport, ok := report.(frontreport.StackReport); ok {
+		stack := h.SourcemapProcessor.ProcessStack(stackReport.GetStack())
+		if omittedFrames > 0 {
+			stack = append(stack, truncatedFrames(omittedFrames))
+		}
+		stackReport.SetStack(stack)
+	}
+	for _, postProcess := range reportType.PostProcessors {
+		postProcess(report)
 	}
 
-	h.ReportStorage.AddReport(report)
+	if !frontreport.PassReport(h.ReportStorage, report, false) {
+		h.metrics.storageFull[reportType.Name].Inc(1)
+		if h.StorageFullStatus != 0 {
+			return errStorageFull
+		}
+	}
 	return nil
 }
+
+// writeStorageFull tells client to deliver reports again later
+func (h *Handler) writeStorageFull(w http.ResponseWriter) {
+	h.setStorageFullRetryAfter(w)
+	w.WriteHeader(h.StorageFullStatus)
+}
+
+func (h *Handler) setStorageFullRetryAfter(w http.ResponseWriter) {
+	if h.StorageFullRetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(h.StorageFullRetryAfter.Seconds()))))
+	}
+}
@@ -0,0 +1,271 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// saturatedStorage refuses every report which may be refused
+type saturatedStorage struct {
+	added   int
+	refused int
+}
+
+func (ss *saturatedStorage) AddReport(frontreport.Reportable) {
+	ss.added++
+}
+
+func (ss *saturatedStorage) TryAddReport(frontreport.Reportable) bool {
+	ss.refused++
+	return false
+}
+
+type noSourcemaps struct{}
+
+func (noSourcemaps) ProcessStack(stack []frontreport.StacktraceJSStackframe) []frontreport.StacktraceJSStackframe {
+	return stack
+}
+
+func post(h *Handler, path, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	h.handleRequest(w, r)
+	return w
+}
+
+func newHandler(storage frontreport.ReportStorage) (*Handler, *frontreporttest.MetricStorage) {
+	metricStorage := frontreporttest.NewMetricStorage()
+	return &Handler{
+		ReportStorage:      storage,
+		SourcemapProcessor: noSourcemaps{},
+		Port:               "0",
+		RoutePrefixes:      []string{"/"},
+		MaxBodySize:        1 << 20,
+		StorageFullStatus:  http.StatusServiceUnavailable,
+		Logger:             log.NewNopLogger(),
+		MetricStorage:      metricStorage,
+	}, metricStorage
+}
+
+// TestStorageFull tests that reports are refused or dropped without blocking when storage is saturated
+func TestStorageFull(t *testing.T) {
+	Convey("Given handler with saturated storage", t, func() {
+		storage := &saturatedStorage{}
+		h, _ := newHandler(storage)
+		h.StorageFullRetryAfter = 30 * time.Second
+		So(h.Start(), ShouldBeNil)
+		defer h.Stop()
+
+		Convey("A report is refused with configured status", func() {
+			w := post(h, "/csp", "application/csp-report", `{"csp-report":{"document-uri":"https://example.com/"}}`)
+			So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "30")
+			So(storage.refused, ShouldEqual, 1)
+			So(storage.added, ShouldEqual, 0)
+		})
+
+		Convey("A batch is refused if none of its reports is stored", func() {
+			w := post(h, "/stacktracejs", "application/json", `[{"message":"a"},{"message":"b"}]`)
+			So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(w.Body.String(), ShouldContainSubstring, `"rejected":2`)
+			So(storage.refused, ShouldEqual, 2)
+		})
+
+		Convey("A Reporting API batch is refused if none of its reports is stored", func() {
+			w := post(h, "/reporting", "application/reports+json", `[{"type":"deprecation","body":{"id":"x"}}]`)
+			So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+
+		Convey("Reports are accepted and dropped without status", func() {
+			h.StorageFullStatus = 0
+			w := post(h, "/csp", "application/csp-report", `{"csp-report":{"document-uri":"https://example.com/"}}`)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(storage.refused, ShouldEqual, 1)
+			So(storage.added, ShouldEqual, 0)
+		})
+	})
+}
+
+// TestReportingAPI tests that Reporting API entries get service from URL and broken batches are refused
+func TestReportingAPI(t *testing.T) {
+	Convey("Given handler with service whitelist", t, func() {
+		storage := &frontreporttest.MemoryStorage{}
+		h, metricStorage := newHandler(storage)
+		h.ServiceWhitelist = map[string]bool{"billing": true}
+		So(h.Start(), ShouldBeNil)
+		defer h.Stop()
+
+		Convey("Entries without service get it from URL query", func() {
+			w := post(h, "/reporting?service=billing", "application/reports+json", `[{"type":"deprecation","body":{"id":"x"}},{"type":"csp-violation","body":{"documentURL":"https://example.com/"}}]`)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(storage.Reports(), ShouldHaveLength, 2)
+			So(storage.Reports()[0].GetService(), ShouldEqual, "billing")
+		})
+
+		Convey("Entries without service are not in whitelist", func() {
+			w := post(h, "/reporting", "application/reports+json", `[{"type":"deprecation","body":{"id":"x"}}]`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(storage.Reports(), ShouldBeEmpty)
+		})
+
+		Convey("A batch is refused if none of its entries is valid", func() {
+			w := post(h, "/reporting?service=billing", "application/reports+json", `[{"type":"unknown"},{"type":"deprecation","body":"x"}]`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(metricStorage.Count("http.report_decoding.reporting.errors"), ShouldEqual, 1)
+			So(metricStorage.Count("http.report_decoding.deprecation.errors"), ShouldEqual, 1)
+
+			w = post(h, "/reporting?service=billing", "application/reports+json", `[{"type":"unknown"},{"type":"deprecation","body":{"id":"x"}}]`)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(storage.Reports(), ShouldHaveLength, 1)
+		})
+	})
+}
+
+// TestNEL tests that Network Error Logging reports are counted by phase and error type
+func TestNEL(t *testing.T) {
+	Convey("Given handler", t, func() {
+		storage := &frontreporttest.MemoryStorage{}
+		h, metricStorage := newHandler(storage)
+		So(h.Start(), ShouldBeNil)
+		defer h.Stop()
+
+		Convey("Network errors are counted by phase and type", func() {
+			w := post(h, "/nel?service=billing", "application/reports+json", `[
+				{"type":"network-error","url":"https://example.com/","body":{"phase":"dns","type":"dns.name_not_resolved","elapsed_time":10}},
+				{"type":"network-error","url":"https://example.com/","body":{"phase":"connection","type":"tcp.timed_out","elapsed_time":20}},
+				{"type":"network-error","url":"https://example.com/","body":{"phase":"warp","type":"made.up","elapsed_time":30}}
+			]`)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(storage.Reports(), ShouldHaveLength, 3)
+			So(storage.Reports()[0].(*frontreport.NELReport).Body.Type, ShouldEqual, "dns.name_not_resolved")
+
+			So(metricStorage.Count("http.report_decoding.nel.phase.dns"), ShouldEqual, 1)
+			So(metricStorage.Count("http.report_decoding.nel.phase.connection"), ShouldEqual, 1)
+			So(metricStorage.Count("http.report_decoding.nel.phase.application"), ShouldEqual, 0)
+			So(metricStorage.Count("http.report_decoding.nel.phase.other"), ShouldEqual, 1)
+			So(metricStorage.Count("http.report_decoding.nel.type.dns_name_not_resolved"), ShouldEqual, 1)
+			So(metricStorage.Count("http.report_decoding.nel.type.tcp_timed_out"), ShouldEqual, 1)
+			So(metricStorage.Count("http.report_decoding.nel.type.other"), ShouldEqual, 1)
+		})
+	})
+}
+
+// TestExpectCT tests that Expect-CT reports are decoded with all their fields and stored to their own indices
+func TestExpectCT(t *testing.T) {
+	Convey("Given handler", t, func() {
+		storage := &frontreporttest.MemoryStorage{}
+		h, _ := newHandler(storage)
+		So(h.Start(), ShouldBeNil)
+		defer h.Stop()
+
+		body := `{"expect-ct-report": {
+			"date-time": "2020-02-14T23:30:00Z",
+			"hostname": "example.com",
+			"port": 443,
+			"effective-expiration-date": "2020-03-14T23:30:00Z",
+			"served-certificate-chain": ["served-leaf", "served-root"],
+			"validated-certificate-chain": ["validated-leaf"],
+			"scts": [{"version": 1, "status": "invalid", "source": "embedded", "serialized_sct": "c2N0"}]
+		}}`
+
+		for path, contentType := range map[string]string{
+			"/expect-ct?service=Billing": "application/json",
+			"/expectct?service=Billing":  "application/json",
+			"/csp?service=Billing":       "application/expect-ct-report+json",
+		} {
+			Convey("A report posted to "+path+" as "+contentType+" is decoded", func() {
+				w := post(h, path, contentType, body)
+				So(w.Code, ShouldEqual, http.StatusNoContent)
+				So(storage.Reports(), ShouldHaveLength, 1)
+
+				report := storage.Reports()[0].(*frontreport.ExpectCTReport)
+				So(report.Body.DateTime, ShouldEqual, "2020-02-14T23:30:00Z")
+				So(report.Body.Hostname, ShouldEqual, "example.com")
+				So(report.Body.Port, ShouldEqual, 443)
+				So(report.Body.EffectiveExpirationDate, ShouldEqual, "2020-03-14T23:30:00Z")
+				So(report.Body.ServedCertificateChain, ShouldResemble, []string{"served-leaf", "served-root"})
+				So(report.Body.ValidatedCertificateChain, ShouldResemble, []string{"validated-leaf"})
+				So(report.Body.SCTs, ShouldHaveLength, 1)
+				So(report.Body.SCTs[0].Version, ShouldEqual, 1)
+				So(report.Body.SCTs[0].Status, ShouldEqual, "invalid")
+				So(report.Body.SCTs[0].Source, ShouldEqual, "embedded")
+				So(report.Body.SCTs[0].SerializedSCT, ShouldEqual, "c2N0")
+
+				now := time.Date(2020, time.February, 14, 12, 0, 0, 0, time.UTC)
+				template := frontreport.IndexTemplate{Template: "{type}-report-{service}-{date}"}
+				So(template.Name(report, now), ShouldEqual, "expectct-report-billing-2020.02.14")
+			})
+		}
+	})
+}
+
+// customReport is a report type registered by a team outside of frontreport
+type customReport struct {
+	frontreport.Report
+	Event     string `json:"event"`
+	Processed bool   `json:"processed"`
+}
+
+func (customReport) GetType() string {
+	return "custom"
+}
+
+// TestCustomRegistry tests that handler discovers report types of its registry on start
+func TestCustomRegistry(t *testing.T) {
+	Convey("Given handler with custom registry", t, func() {
+		registry := &frontreport.ReportTypeRegistry{}
+		So(registry.Register(frontreport.ReportType{
+			Name:         "custom",
+			Paths:        []string{"custom", "events"},
+			ContentTypes: []string{"application/custom+json"},
+			New:          func() frontreport.Reportable { return &customReport{} },
+			Validators: []frontreport.Validator{
+				func(report frontreport.Reportable) error {
+					if report.(*customReport).Event == "" {
+						return errors.New("no event")
+					}
+					return nil
+				},
+			},
+			PostProcessors: []frontreport.PostProcessor{
+				func(report frontreport.Reportable) {
+					report.(*customReport).Processed = true
+				},
+			},
+		}), ShouldBeNil)
+
+		storage := &frontreporttest.MemoryStorage{}
+		h, metricStorage := newHandler(storage)
+		h.Registry = registry
+		So(h.Start(), ShouldBeNil)
+		defer h.Stop()
+
+		Convey("Reports of registered type are routed, validated and post-processed", func() {
+			So(post(h, "/custom", "application/json", `{"event":"click"}`).Code, ShouldEqual, http.StatusNoContent)
+			So(post(h, "/events", "application/json", `{"event":"scroll"}`).Code, ShouldEqual, http.StatusNoContent)
+			So(post(h, "/custom", "application/json", `{}`).Code, ShouldEqual, http.StatusBadRequest)
+
+			So(storage.Reports(), ShouldHaveLength, 2)
+			So(storage.Reports()[0].(*customReport).Event, ShouldEqual, "click")
+			So(storage.Reports()[0].(*customReport).Processed, ShouldBeTrue)
+			So(metricStorage.Count("http.report_decoding.custom.total"), ShouldEqual, 3)
+			So(metricStorage.Count("http.report_decoding.custom.errors"), ShouldEqual, 1)
+		})
+
+		Convey("Types missing from the registry are not routed", func() {
+			So(post(h, "/csp", "application/csp-report", `{"csp-report":{}}`).Code, ShouldEqual, http.StatusNotFound)
+			So(storage.Reports(), ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,95 @@
+package http
+
+import (
+	"strings"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// router resolves report type of a request by its URL path and content type
+type router struct {
+	types        []frontreport.ReportType
+	routes       map[string]frontreport.ReportType
+	contentTypes map[string]frontreport.ReportType
+	compat       bool
+}
+
+// newRouter makes a route for every report type path under every prefix,
+// in compatibility mode URL path not matching any route only needs to contain
+// one of report type compatibility paths like it used to
+func newRouter(registry *frontreport.ReportTypeRegistry, prefixes []string, compat bool) *router {
+	rt := &router{
+		types:        registry.Types(),
+		routes:       make(map[string]frontreport.ReportType),
+		contentTypes: make(map[string]frontreport.ReportType),
+		compat:       compat,
+	}
+	if len(prefixes) == 0 {
+		prefixes = []string{"/"}
+	}
+
+	for _, reportType := range rt.types {
+		for _, contentType := range reportType.ContentTypes {
+			if _, found := rt.contentTypes[contentType]; !found {
+				rt.contentTypes[contentType] = reportType
+			}
+		}
+		for _, prefix := range prefixes {
+			for _, path := range reportType.Paths {
+				route := normalizePrefix(prefix) + strings.Trim(path, "/")
+				if _, found := rt.routes[route]; !found {
+					rt.routes[route] = reportType
+				}
+			}
+		}
+	}
+	return rt
+}
+
+// route returns report type for a request, content type is more specific than URL path,
+// so it wins over path unless the path is not a known route at all
+func (rt *router) route(path, contentType string) (frontreport.ReportType, bool) {
+	if rt.compat {
+		return rt.routeCompat(path, contentType)
+	}
+
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	reportType, found := rt.routes[path]
+	if !found {
+		return frontreport.ReportType{}, false
+	}
+	if byContentType, found := rt.contentTypes[contentType]; found {
+		return byContentType, true
+	}
+	return reportType, true
+}
+
+func (rt *router) routeCompat(path, contentType string) (frontreport.ReportType, bool) {
+	if reportType, found := rt.contentTypes[contentType]; found {
+		return reportType, true
+	}
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	if reportType, found := rt.routes[path]; found {
+		return reportType, true
+	}
+	for _, reportType := range rt.types {
+		for _, p := range reportType.CompatPaths {
+			if strings.Contains(path, p) {
+				return reportType, true
+			}
+		}
+	}
+	return frontreport.ReportType{}, false
+}
+
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "/"
+	}
+	return "/" + prefix + "/"
+}
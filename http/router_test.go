@@ -0,0 +1,82 @@
+package http
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// TestRouter tests exact and compatibility routing of built-in report types
+func TestRouter(t *testing.T) {
+	Convey("Using exact routes", t, func() {
+		rt := newRouter(frontreport.DefaultRegistry, []string{"/", "_reports"}, false)
+
+		for path, name := range map[string]string{
+			"/csp":                   "csp",
+			"/csp/":                  "csp",
+			"/_reports/csp":          "csp",
+			"/_reports/stacktracejs": "stacktracejs",
+			"/_reports/expect-ct/":   "expectct",
+			"/nel":                   "reporting",
+		} {
+			reportType, found := rt.route(path, "application/json")
+			So(found, ShouldBeTrue)
+			So(reportType.Name, ShouldEqual, name)
+		}
+
+		for _, path := range []string{
+			"/",
+			"/cspx",
+			"/api/stacktracejs-cspx",
+			"/_reports/csp/extra",
+			"/_reports/_reports/csp",
+			"/pkp.html",
+		} {
+			_, found := rt.route(path, "application/json")
+			So(found, ShouldBeFalse)
+		}
+	})
+
+	Convey("Content type wins over known route", t, func() {
+		rt := newRouter(frontreport.DefaultRegistry, []string{"/_reports/"}, false)
+
+		reportType, found := rt.route("/_reports/csp", "application/reports+json")
+		So(found, ShouldBeTrue)
+		So(reportType.Name, ShouldEqual, "reporting")
+
+		_, found = rt.route("/unknown", "application/reports+json")
+		So(found, ShouldBeFalse)
+	})
+
+	Convey("Using compatibility mode", t, func() {
+		rt := newRouter(frontreport.DefaultRegistry, nil, true)
+
+		reportType, found := rt.route("/api/stacktracejs-cspx", "application/json")
+		So(found, ShouldBeTrue)
+		So(reportType.Name, ShouldEqual, "csp")
+
+		reportType, found = rt.route("/unknown", "application/reports+json")
+		So(found, ShouldBeTrue)
+		So(reportType.Name, ShouldEqual, "reporting")
+
+		reportType, found = rt.route("/nel", "application/json")
+		So(found, ShouldBeTrue)
+		So(reportType.Name, ShouldEqual, "reporting")
+
+		for path, name := range map[string]string{
+			"/channel/csp":   "csp",
+			"/tunnel/pkp":    "pkp",
+			"/panel/errors":  "",
+			"/api/reporting": "",
+		} {
+			reportType, found = rt.route(path, "application/json")
+			So(found, ShouldEqual, name != "")
+			So(reportType.Name, ShouldEqual, name)
+		}
+
+		_, found = rt.route("/unknown", "application/json")
+		So(found, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,108 @@
+package frontreport
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultIndexDateLayout is a layout of {date} placeholder without explicit layout, it makes daily indices
+const DefaultIndexDateLayout = "2006.01.02"
+
+var indexPlaceholderRegexp = regexp.MustCompile(`(-?)\{([a-z]+)(?::([^}]*))?\}`)
+
+// indexForbiddenRegexp matches characters Elasticsearch does not allow in index names
+var indexForbiddenRegexp = regexp.MustCompile(`[\\/*?"<>| ,#:]`)
+
+// IndexTemplate names an index, a topic or alike after a report, e.g. "{type}-report-{service}-{date:2006.01}":
+// {type}, {service} and {host} are replaced with report type, service and host, {environment} with Environment,
+// {date} with current UTC date in Go time layout given after colon (DefaultIndexDateLayout if there is none)
+// and {week} with ISO year and week, e.g. 2020.w07; reports without service get EmptyService,
+// a placeholder left empty is removed along with a dash in front of it
+type IndexTemplate struct {
+	Template     string
+	Environment  string
+	EmptyService string
+	// Hosts are the only hosts {host} is replaced with, as IndexHost makes them, since clients may send
+	// any Host header and make up any number of indices; {host} of other hosts is left empty
+	Hosts map[string]bool
+}
+
+// Validate checks that template has only known placeholders and {host} has hosts to be replaced with
+func (t IndexTemplate) Validate() error {
+	for _, match := range indexPlaceholderRegexp.FindAllStringSubmatch(t.Template, -1) {
+		switch name, layout := match[2], match[3]; {
+		case name == "date":
+		case layout != "":
+			return fmt.Errorf("index template %s: only {date} placeholder takes a layout, got %s", t.Template, match[0])
+		case name == "host" && len(t.Hosts) == 0:
+			return fmt.Errorf("index template %s: {host} placeholder requires a list of hosts", t.Template)
+		case name != "type" && name != "service" && name != "host" && name != "environment" && name != "week":
+			return fmt.Errorf("index template %s: unknown placeholder %s", t.Template, match[0])
+		}
+	}
+	return nil
+}
+
+// Dated tells if template has {date} or {week} placeholder, so that it names a new index from time to time
+func (t IndexTemplate) Dated() bool {
+	for _, match := range indexPlaceholderRegexp.FindAllStringSubmatch(t.Template, -1) {
+		if match[2] == "date" || match[2] == "week" {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexHost makes a host fit into an index name: it is lowercased, its port is stripped
+// and characters Elasticsearch forbids in index names are replaced with underscores
+func IndexHost(host string) string {
+	host = strings.ToLower(host)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return indexForbiddenRegexp.ReplaceAllString(host, "_")
+}
+
+// Name returns index name of a report stored at given time
+func (t IndexTemplate) Name(report Reportable, now time.Time) string {
+	now = now.UTC()
+	return indexPlaceholderRegexp.ReplaceAllStringFunc(t.Template, func(placeholder string) string {
+		match := indexPlaceholderRegexp.FindStringSubmatch(placeholder)
+		var value string
+		switch match[2] {
+		case "type":
+			value = report.GetType()
+		case "service":
+			if value = report.GetService(); value == "" {
+				value = t.EmptyService
+			}
+		case "host":
+			if hostReport, ok := report.(HostReport); ok {
+				if host := IndexHost(hostReport.GetHost()); t.Hosts[host] {
+					value = host
+				}
+			}
+		case "environment":
+			value = t.Environment
+		case "date":
+			layout := match[3]
+			if layout == "" {
+				layout = DefaultIndexDateLayout
+			}
+			value = now.Format(layout)
+		case "week":
+			year, week := now.ISOWeek()
+			value = fmt.Sprintf("%d.w%02d", year, week)
+		default:
+			return placeholder
+		}
+		if value == "" {
+			return ""
+		}
+		return match[1] + value
+	})
+}
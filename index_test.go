@@ -0,0 +1,68 @@
+package frontreport
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// TestIndexTemplate tests that index names are made of report fields, environment and date
+func TestIndexTemplate(t *testing.T) {
+	now := time.Date(2020, time.February, 14, 23, 30, 0, 0, time.FixedZone("UTC+3", 3*60*60))
+
+	report := &StacktraceJSReport{}
+	report.Service = "Billing"
+	report.Host = "example.com"
+	anonymous := &CSPReport{}
+
+	Convey("Default template makes daily indices", t, func() {
+		template := IndexTemplate{Template: "{type}-report-{service}-{date}"}
+		So(template.Validate(), ShouldBeNil)
+		So(template.Name(report, now), ShouldEqual, "stacktracejs-report-billing-2020.02.14")
+		So(template.Name(anonymous, now), ShouldEqual, "csp-report-2020.02.14")
+	})
+
+	Convey("Date layout, week, host and environment are substituted", t, func() {
+		So(IndexTemplate{Template: "{type}-{date:2006.01}"}.Name(report, now), ShouldEqual, "stacktracejs-2020.02")
+		So(IndexTemplate{Template: "{type}-{week}"}.Name(report, now), ShouldEqual, "stacktracejs-2020.w07")
+		hosts := map[string]bool{"example.com": true}
+		So(IndexTemplate{Template: "{environment}-{type}-{host}", Environment: "staging", Hosts: hosts}.Name(report, now), ShouldEqual, "staging-stacktracejs-example.com")
+		So(IndexTemplate{Template: "{type}-{environment}-{host}", Hosts: hosts}.Name(anonymous, now), ShouldEqual, "csp")
+	})
+
+	Convey("Only listed hosts are substituted after they are made to fit into an index name", t, func() {
+		template := IndexTemplate{Template: "{type}-{host}", Hosts: map[string]bool{"example.com": true, IndexHost("[::1]"): true}}
+		So(template.Validate(), ShouldBeNil)
+		for host, name := range map[string]string{
+			"Example.COM:8080": "stacktracejs-example.com",
+			"example.com":      "stacktracejs-example.com",
+			"evil.example.com": "stacktracejs",
+			"[::1]:443":        "stacktracejs-__1",
+			"example.com/a b":  "stacktracejs",
+		} {
+			report.Host = host
+			So(template.Name(report, now), ShouldEqual, name)
+		}
+		So(IndexHost("Exa mple,COM#1"), ShouldEqual, "exa_mple_com_1")
+	})
+
+	Convey("Dated templates are told apart", t, func() {
+		So(IndexTemplate{Template: "{type}-{date:2006.01}"}.Dated(), ShouldBeTrue)
+		So(IndexTemplate{Template: "{type}-{week}"}.Dated(), ShouldBeTrue)
+		So(IndexTemplate{Template: "{type}-report-{service}"}.Dated(), ShouldBeFalse)
+	})
+
+	Convey("Reports without service get fallback", t, func() {
+		template := IndexTemplate{Template: "{type}-report-{service}-{date}", EmptyService: "unknown"}
+		So(template.Name(anonymous, now), ShouldEqual, "csp-report-unknown-2020.02.14")
+		So(template.Name(report, now), ShouldEqual, "stacktracejs-report-billing-2020.02.14")
+	})
+
+	Convey("Unknown placeholders are not valid", t, func() {
+		So(IndexTemplate{Template: "{type}-{month}"}.Validate(), ShouldNotBeNil)
+		So(IndexTemplate{Template: "{type:2006}"}.Validate(), ShouldNotBeNil)
+		So(IndexTemplate{Template: "{type}-{host}"}.Validate(), ShouldNotBeNil)
+		So(IndexTemplate{Template: "{type}-{week}-{date:2006}-{environment}-{host}", Hosts: map[string]bool{"example.com": true}}.Validate(), ShouldBeNil)
+	})
+}
@@ -9,6 +9,7 @@ type Logger interface {
 type MetricStorage interface {
 	RegisterHistogram(string) MetricHistogram
 	RegisterCounter(string) MetricCounter
+	RegisterGauge(string) MetricGauge
 }
 
 // MetricHistogram is a simple histogram
@@ -21,6 +22,11 @@ type MetricCounter interface {
 	Inc(int64)
 }
 
+// MetricGauge is a simple gauge
+type MetricGauge interface {
+	Update(int64)
+}
+
 // Service is started and stopped in main function, which assembles services into a working application
 type Service interface {
 	Start() error
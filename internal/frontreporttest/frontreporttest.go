@@ -0,0 +1,81 @@
+// Package frontreporttest provides storages for tests of report processing
+package frontreporttest
+
+import (
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// MemoryStorage is a frontreport.ReportStorage which remembers all reports
+type MemoryStorage struct {
+	mu      sync.Mutex
+	reports []frontreport.Reportable
+}
+
+// AddReport remembers a report
+func (ms *MemoryStorage) AddReport(report frontreport.Reportable) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.reports = append(ms.reports, report)
+}
+
+// AddFailedReports remembers reports a storage failed to send, so that it can be a frontreport.FailedReportStorage
+func (ms *MemoryStorage) AddFailedReports(reports []frontreport.Reportable) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.reports = append(ms.reports, reports...)
+}
+
+// Reports returns reports in order they were added
+func (ms *MemoryStorage) Reports() []frontreport.Reportable {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return append([]frontreport.Reportable(nil), ms.reports...)
+}
+
+// MetricStorage is an in-memory frontreport.MetricStorage which tells metric values by name
+type MetricStorage struct {
+	registry metrics.Registry
+}
+
+// NewMetricStorage returns an empty metric storage, it needs no Start
+func NewMetricStorage() *MetricStorage {
+	return &MetricStorage{registry: metrics.NewRegistry()}
+}
+
+// RegisterHistogram creates a uniform-sampled histogram of integers
+func (ms *MetricStorage) RegisterHistogram(name string) frontreport.MetricHistogram {
+	return metrics.GetOrRegisterHistogram(name, ms.registry, metrics.NewUniformSample(1000))
+}
+
+// RegisterCounter creates a counter
+func (ms *MetricStorage) RegisterCounter(name string) frontreport.MetricCounter {
+	return metrics.GetOrRegisterCounter(name, ms.registry)
+}
+
+// RegisterGauge creates a gauge
+func (ms *MetricStorage) RegisterGauge(name string) frontreport.MetricGauge {
+	return metrics.GetOrRegisterGauge(name, ms.registry)
+}
+
+// Count returns value of a counter or count of a histogram, it is 0 for unknown metrics
+func (ms *MetricStorage) Count(name string) int64 {
+	switch metric := ms.registry.Get(name).(type) {
+	case metrics.Counter:
+		return metric.Count()
+	case metrics.Histogram:
+		return metric.Count()
+	}
+	return 0
+}
+
+// Value returns value of a gauge, it is 0 for unknown metrics
+func (ms *MetricStorage) Value(name string) int64 {
+	if gauge, ok := ms.registry.Get(name).(metrics.Gauge); ok {
+		return gauge.Value()
+	}
+	return 0
+}
@@ -0,0 +1,250 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"gopkg.in/tomb.v2"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// ReportStorage is a Kafka implementation of frontreport.ReportStorage interface, messages are queued
+// for PendingWorkCapacity in front of producer input, which accepts a message only when producer is ready to take it
+type ReportStorage struct {
+	Brokers             []string
+	Topic               frontreport.IndexTemplate
+	Version             string
+	RequiredAcks        string
+	MaxRetries          int
+	RetryBackoff        time.Duration
+	MaxBatchSize        int
+	BatchTimeout        time.Duration
+	PendingWorkCapacity int
+	// FailedReportStorage gets reports which failed to produce after all retries instead of dropping them
+	FailedReportStorage frontreport.FailedReportStorage
+	Logger              frontreport.Logger
+	MetricStorage       frontreport.MetricStorage
+	producer            sarama.AsyncProducer
+	input               chan *sarama.ProducerMessage
+	tomb                tomb.Tomb
+	syncProducer        sarama.SyncProducer
+	mu                  sync.Mutex
+	metrics             struct {
+		messageSizeBytes     frontreport.MetricHistogram
+		produceErrors        frontreport.MetricCounter
+		reportEncodingErrors frontreport.MetricCounter
+		queueFull            frontreport.MetricCounter
+	}
+}
+
+// Start connects to Kafka brokers and starts async producer
+func (rs *ReportStorage) Start() error {
+	rs.metrics.messageSizeBytes = rs.MetricStorage.RegisterHistogram("kafka.message_size_bytes")
+	rs.metrics.produceErrors = rs.MetricStorage.RegisterCounter("kafka.produce.errors")
+	rs.metrics.reportEncodingErrors = rs.MetricStorage.RegisterCounter("kafka.report_encoding.errors")
+	rs.metrics.queueFull = rs.MetricStorage.RegisterCounter("kafka.queue.full")
+
+	config, err := rs.config()
+	if err != nil {
+		return err
+	}
+	rs.producer, err = sarama.NewAsyncProducer(rs.Brokers, config)
+	if err != nil {
+		return err
+	}
+
+	rs.input = make(chan *sarama.ProducerMessage, rs.PendingWorkCapacity)
+	rs.tomb.Go(func() error {
+		for message := range rs.input {
+			rs.producer.Input() <- message
+		}
+		rs.producer.AsyncClose()
+		return nil
+	})
+	rs.tomb.Go(func() error {
+		for err := range rs.producer.Errors() {
+			rs.Logger.Log("msg", "failed to produce message", "topic", err.Msg.Topic, "error", err.Err)
+			rs.metrics.produceErrors.Inc(1)
+			if rs.FailedReportStorage != nil && isRetryable(err.Err) {
+				rs.FailedReportStorage.AddFailedReports([]frontreport.Reportable{err.Msg.Metadata.(frontreport.Reportable)})
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+// Stop flushes queued and pending messages and closes producers
+func (rs *ReportStorage) Stop() error {
+	close(rs.input)
+	err := rs.tomb.Wait()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.syncProducer != nil {
+		if errClose := rs.syncProducer.Close(); err == nil {
+			err = errClose
+		}
+	}
+	return err
+}
+
+// AddReport adds a report of any type to next batch, reports are keyed by service
+// so that reports of a service get into the same partition
+func (rs *ReportStorage) AddReport(report frontreport.Reportable) {
+	if message := rs.newMessage(report); message != nil {
+		rs.input <- message
+	}
+}
+
+// TryAddReport is AddReport which returns false instead of blocking when the queue is full
+func (rs *ReportStorage) TryAddReport(report frontreport.Reportable) bool {
+	message := rs.newMessage(report)
+	if message == nil {
+		return true
+	}
+	select {
+	case rs.input <- message:
+		return true
+	default:
+		rs.metrics.queueFull.Inc(1)
+		return false
+	}
+}
+
+// SendReports produces reports at once and returns the ones worth producing again,
+// reports rejected for good are only logged and counted
+func (rs *ReportStorage) SendReports(reports []frontreport.Reportable) ([]frontreport.Reportable, error) {
+	var messages []*sarama.ProducerMessage
+	for _, report := range reports {
+		if message := rs.newMessage(report); message != nil {
+			messages = append(messages, message)
+		}
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	producer, err := rs.getSyncProducer()
+	if err != nil {
+		return messageReports(messages), err
+	}
+	err = producer.SendMessages(messages)
+	if err == nil {
+		return nil, nil
+	}
+	errs, ok := err.(sarama.ProducerErrors)
+	if !ok {
+		rs.metrics.produceErrors.Inc(int64(len(messages)))
+		return messageReports(messages), err
+	}
+
+	var retry []*sarama.ProducerMessage
+	for _, err := range errs {
+		rs.Logger.Log("msg", "failed to produce message", "topic", err.Msg.Topic, "error", err.Err)
+		rs.metrics.produceErrors.Inc(1)
+		if isRetryable(err.Err) {
+			retry = append(retry, err.Msg)
+		}
+	}
+	if len(retry) == 0 {
+		return nil, nil
+	}
+	return messageReports(retry), errs
+}
+
+// getSyncProducer makes a producer to send reports at once on first use, as only spooled reports are sent this way;
+// if it fails to connect to brokers, it is made again on next use
+func (rs *ReportStorage) getSyncProducer() (sarama.SyncProducer, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.syncProducer != nil {
+		return rs.syncProducer, nil
+	}
+	config, err := rs.config()
+	if err != nil {
+		return nil, err
+	}
+	config.Producer.Return.Successes = true
+	rs.syncProducer, err = sarama.NewSyncProducer(rs.Brokers, config)
+	return rs.syncProducer, err
+}
+
+func (rs *ReportStorage) newMessage(report frontreport.Reportable) *sarama.ProducerMessage {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		rs.Logger.Log("msg", "failed to encode", "report_type", report.GetType(), "error", err)
+		rs.metrics.reportEncodingErrors.Inc(1)
+		return nil
+	}
+
+	rs.metrics.messageSizeBytes.Update(int64(len(reportJSON)))
+	return &sarama.ProducerMessage{
+		Topic: rs.Topic.Name(report, frontreport.ReceivedAt(report)),
+		Key:   sarama.StringEncoder(report.GetService()),
+		Value: sarama.ByteEncoder(reportJSON),
+		// report is kept to pass it to FailedReportStorage if the message fails
+		Metadata: report,
+	}
+}
+
+func messageReports(messages []*sarama.ProducerMessage) []frontreport.Reportable {
+	var reports []frontreport.Reportable
+	for _, message := range messages {
+		reports = append(reports, message.Metadata.(frontreport.Reportable))
+	}
+	return reports
+}
+
+// isRetryable tells if a message failed after all retries may be produced later, a message rejected
+// because it is invalid, too large or not allowed is rejected for good
+func isRetryable(err error) bool {
+	switch err {
+	case sarama.ErrInvalidMessage, sarama.ErrInvalidMessageSize, sarama.ErrMessageSizeTooLarge, sarama.ErrMessageSetSizeTooLarge,
+		sarama.ErrInvalidTopic, sarama.ErrTopicAuthorizationFailed:
+		return false
+	}
+	return true
+}
+
+func (rs *ReportStorage) config() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = "frontreport"
+	if rs.Version != "" {
+		version, err := sarama.ParseKafkaVersion(rs.Version)
+		if err != nil {
+			return nil, err
+		}
+		config.Version = version
+	}
+
+	switch rs.RequiredAcks {
+	case "none":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	case "leader", "":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "all":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		return nil, fmt.Errorf("invalid required acks %q, must be none, leader or all", rs.RequiredAcks)
+	}
+	config.Producer.Retry.Max = rs.MaxRetries
+	if rs.RetryBackoff > 0 {
+		config.Producer.Retry.Backoff = rs.RetryBackoff
+	}
+
+	config.Producer.Flush.MaxMessages = rs.MaxBatchSize
+	config.Producer.Flush.Messages = rs.MaxBatchSize
+	config.Producer.Flush.Frequency = rs.BatchTimeout
+	if rs.PendingWorkCapacity > 0 {
+		config.ChannelBufferSize = rs.PendingWorkCapacity
+	}
+	config.Producer.Return.Errors = true
+	config.Producer.Return.Successes = false
+
+	return config, config.Validate()
+}
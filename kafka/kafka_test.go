@@ -0,0 +1,221 @@
+package kafka
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+type counter struct {
+	count int64
+}
+
+func (c *counter) Inc(n int64) {
+	atomic.AddInt64(&c.count, n)
+}
+
+func (c *counter) Update(int64) {}
+
+type metricStorage map[string]*counter
+
+func (ms metricStorage) RegisterCounter(name string) frontreport.MetricCounter {
+	ms[name] = &counter{}
+	return ms[name]
+}
+
+func (ms metricStorage) RegisterHistogram(name string) frontreport.MetricHistogram {
+	return ms.RegisterCounter(name).(*counter)
+}
+
+func (ms metricStorage) RegisterGauge(name string) frontreport.MetricGauge {
+	return ms.RegisterCounter(name).(*counter)
+}
+
+func produceRequests(broker *sarama.MockBroker) int {
+	count := 0
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			count++
+		}
+	}
+	return count
+}
+
+// TestReportStorage tests that reports are produced to topics named after report type and service
+func TestReportStorage(t *testing.T) {
+	Convey("Given Kafka storage and a fake broker", t, func() {
+		broker := sarama.NewMockBroker(t, 1)
+		defer broker.Close()
+		broker.SetHandlerByMap(map[string]sarama.MockResponse{
+			"MetadataRequest": sarama.NewMockMetadataResponse(t).
+				SetBroker(broker.Addr(), broker.BrokerID()).
+				SetLeader("csp-report-billing", 0, broker.BrokerID()).
+				SetLeader("stacktracejs-report", 0, broker.BrokerID()),
+			"ProduceRequest": sarama.NewMockProduceResponse(t).
+				SetError("stacktracejs-report", 0, sarama.ErrMessageSizeTooLarge),
+		})
+
+		metricStorage := metricStorage{}
+		rs := &ReportStorage{
+			Brokers:       []string{broker.Addr()},
+			Topic:         frontreport.IndexTemplate{Template: "{type}-report-{service}"},
+			MaxBatchSize:  10,
+			BatchTimeout:  10 * time.Millisecond,
+			Logger:        log.NewNopLogger(),
+			MetricStorage: metricStorage,
+		}
+		So(rs.Start(), ShouldBeNil)
+
+		cspReport := &frontreport.CSPReport{}
+		cspReport.Service = "Billing"
+		So(rs.Topic.Name(cspReport, time.Now()), ShouldEqual, "csp-report-billing")
+		stacktraceJSReport := &frontreport.StacktraceJSReport{}
+		So(rs.Topic.Name(stacktraceJSReport, time.Now()), ShouldEqual, "stacktracejs-report")
+
+		rs.AddReport(cspReport)
+		rs.AddReport(stacktraceJSReport)
+		So(rs.Stop(), ShouldBeNil)
+
+		So(produceRequests(broker), ShouldBeGreaterThan, 0)
+		So(metricStorage["kafka.produce.errors"].count, ShouldEqual, 1)
+	})
+
+	Convey("Given Kafka storage with pending work capacity", t, func() {
+		broker := sarama.NewMockBroker(t, 1)
+		defer broker.Close()
+		broker.SetHandlerByMap(map[string]sarama.MockResponse{
+			"MetadataRequest": sarama.NewMockMetadataResponse(t).
+				SetBroker(broker.Addr(), broker.BrokerID()).
+				SetLeader("csp-report-billing", 0, broker.BrokerID()),
+			"ProduceRequest": sarama.NewMockProduceResponse(t),
+		})
+
+		metricStorage := metricStorage{}
+		rs := &ReportStorage{
+			Brokers:             []string{broker.Addr()},
+			Topic:               frontreport.IndexTemplate{Template: "{type}-report-{service}"},
+			MaxBatchSize:        10,
+			BatchTimeout:        10 * time.Millisecond,
+			PendingWorkCapacity: 100,
+			Logger:              log.NewNopLogger(),
+			MetricStorage:       metricStorage,
+		}
+		So(rs.Start(), ShouldBeNil)
+
+		Convey("Concurrent reports within capacity are not refused", func() {
+			var refused int64
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						cspReport := &frontreport.CSPReport{}
+						cspReport.Service = "billing"
+						if !rs.TryAddReport(cspReport) {
+							atomic.AddInt64(&refused, 1)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			So(rs.Stop(), ShouldBeNil)
+
+			So(refused, ShouldEqual, 0)
+			So(metricStorage["kafka.queue.full"].count, ShouldEqual, 0)
+			So(metricStorage["kafka.produce.errors"].count, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given Kafka storage and a fake broker failing some topics", t, func() {
+		broker := sarama.NewMockBroker(t, 1)
+		defer broker.Close()
+		broker.SetHandlerByMap(map[string]sarama.MockResponse{
+			"MetadataRequest": sarama.NewMockMetadataResponse(t).
+				SetBroker(broker.Addr(), broker.BrokerID()).
+				SetLeader("csp-report-billing", 0, broker.BrokerID()).
+				SetLeader("stacktracejs-report", 0, broker.BrokerID()).
+				SetLeader("custom-report", 0, broker.BrokerID()),
+			"ProduceRequest": sarama.NewMockProduceResponse(t).
+				SetError("stacktracejs-report", 0, sarama.ErrMessageSizeTooLarge).
+				SetError("custom-report", 0, sarama.ErrNotEnoughReplicas),
+		})
+
+		metricStorage := metricStorage{}
+		failedStorage := &frontreporttest.MemoryStorage{}
+		rs := &ReportStorage{
+			Brokers:             []string{broker.Addr()},
+			Topic:               frontreport.IndexTemplate{Template: "{type}-report-{service}"},
+			MaxBatchSize:        10,
+			BatchTimeout:        10 * time.Millisecond,
+			FailedReportStorage: failedStorage,
+			Logger:              log.NewNopLogger(),
+			MetricStorage:       metricStorage,
+		}
+		So(rs.Start(), ShouldBeNil)
+
+		cspReport := &frontreport.CSPReport{}
+		cspReport.Service = "billing"
+		stacktraceJSReport := &frontreport.StacktraceJSReport{}
+		customReport := &frontreport.RawReport{Type: "custom", JSON: []byte(`{}`)}
+
+		Convey("Reports which failed to produce and are worth producing again are passed to failed report storage", func() {
+			rs.AddReport(cspReport)
+			rs.AddReport(stacktraceJSReport)
+			rs.AddReport(customReport)
+			So(rs.Stop(), ShouldBeNil)
+
+			So(failedStorage.Reports(), ShouldResemble, []frontreport.Reportable{customReport})
+			So(metricStorage["kafka.produce.errors"].count, ShouldEqual, 2)
+		})
+
+		Convey("Sending reports at once returns the ones worth producing again", func() {
+			retry, err := rs.SendReports([]frontreport.Reportable{cspReport, stacktraceJSReport, customReport})
+			So(err, ShouldNotBeNil)
+			So(retry, ShouldResemble, []frontreport.Reportable{customReport})
+
+			retry, err = rs.SendReports([]frontreport.Reportable{cspReport})
+			So(err, ShouldBeNil)
+			So(retry, ShouldBeEmpty)
+			So(rs.Stop(), ShouldBeNil)
+
+			So(failedStorage.Reports(), ShouldBeEmpty)
+			So(metricStorage["kafka.produce.errors"].count, ShouldEqual, 2)
+		})
+	})
+
+	Convey("Sending reports at once returns them all if brokers are unavailable", t, func() {
+		broker := sarama.NewMockBroker(t, 1)
+		broker.SetHandlerByMap(map[string]sarama.MockResponse{
+			"MetadataRequest": sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID()),
+		})
+		rs := &ReportStorage{
+			Brokers:       []string{broker.Addr()},
+			Topic:         frontreport.IndexTemplate{Template: "{type}-report"},
+			Logger:        log.NewNopLogger(),
+			MetricStorage: metricStorage{},
+		}
+		So(rs.Start(), ShouldBeNil)
+		broker.Close()
+
+		reports := []frontreport.Reportable{&frontreport.CSPReport{}, &frontreport.StacktraceJSReport{}}
+		retry, err := rs.SendReports(reports)
+		So(err, ShouldNotBeNil)
+		So(retry, ShouldResemble, reports)
+		So(rs.Stop(), ShouldBeNil)
+	})
+
+	Convey("Invalid acks are rejected", t, func() {
+		rs := &ReportStorage{RequiredAcks: "some"}
+		_, err := rs.config()
+		So(err, ShouldNotBeNil)
+	})
+}
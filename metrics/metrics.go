@@ -55,3 +55,8 @@ func (ms *MetricStorage) RegisterHistogram(name string) frontreport.MetricHistog
 func (ms *MetricStorage) RegisterCounter(name string) frontreport.MetricCounter {
 	return metrics.NewRegisteredCounter(name, ms.registry)
 }
+
+// RegisterGauge creates a gauge
+func (ms *MetricStorage) RegisterGauge(name string) frontreport.MetricGauge {
+	return metrics.NewRegisteredGauge(name, ms.registry)
+}
@@ -0,0 +1,214 @@
+package frontreport
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Validator rejects a decoded report which should not be stored
+type Validator func(Reportable) error
+
+// PostProcessor modifies a valid report right before it is stored
+type PostProcessor func(Reportable)
+
+// ReportType describes a report family: which requests carry it, how to construct, validate and post-process it
+type ReportType struct {
+	// Name must be equal to GetType() of reports of this type, it is used in metric names
+	Name string
+	// Paths route requests to this type, e.g. "csp" means /csp under every configured route prefix
+	Paths []string
+	// CompatPaths are URL path substrings routing requests to this type in compatibility mode,
+	// they must not be parts of other paths, e.g. "nel" would take /channel or /tunnel/csp
+	CompatPaths []string
+	// ContentTypes route requests with any of these media types regardless of URL path
+	ContentTypes []string
+	// ReportingAPIType is an entry type of W3C Reporting API batch decoded into this report type
+	ReportingAPIType string
+	// ReportingAPIBatch marks a W3C Reporting API batch, its entries are resolved to report types by ReportingAPIType
+	ReportingAPIBatch bool
+	// Batchable allows request body to hold a JSON array or newline-delimited JSON objects instead of a single report
+	Batchable bool
+	// New returns an empty report to decode request into, it is not used for batches
+	New            func() Reportable
+	Validators     []Validator
+	PostProcessors []PostProcessor
+}
+
+// ReportTypeRegistry holds report types in order of registration
+type ReportTypeRegistry struct {
+	mu    sync.RWMutex
+	types []ReportType
+}
+
+// Register adds a new report type, names, paths, content types and Reporting API types must be unique
+func (rr *ReportTypeRegistry) Register(reportType ReportType) error {
+	if reportType.Name == "" {
+		return fmt.Errorf("report type has no name")
+	}
+	if !reportType.ReportingAPIBatch {
+		if reportType.New == nil {
+			return fmt.Errorf("report type %s has no constructor", reportType.Name)
+		}
+		if t := reportType.New().GetType(); t != reportType.Name {
+			return fmt.Errorf("report type %s constructs reports of type %s", reportType.Name, t)
+		}
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	for _, t := range rr.types {
+		if t.Name == reportType.Name {
+			return fmt.Errorf("report type %s is already registered", reportType.Name)
+		}
+		if reportType.ReportingAPIType != "" && t.ReportingAPIType == reportType.ReportingAPIType {
+			return fmt.Errorf("report type %s already handles Reporting API type %s", t.Name, reportType.ReportingAPIType)
+		}
+		if path, found := common(t.Paths, reportType.Paths); found {
+			return fmt.Errorf("report type %s already handles path %s", t.Name, path)
+		}
+		if path, found := common(t.CompatPaths, reportType.CompatPaths); found {
+			return fmt.Errorf("report type %s already handles compatibility path %s", t.Name, path)
+		}
+		if contentType, found := common(t.ContentTypes, reportType.ContentTypes); found {
+			return fmt.Errorf("report type %s already handles content type %s", t.Name, contentType)
+		}
+	}
+	rr.types = append(rr.types, reportType)
+	return nil
+}
+
+// common finds a string present in both lists
+func common(a, b []string) (string, bool) {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return x, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Types returns all registered report types
+func (rr *ReportTypeRegistry) Types() []ReportType {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	return append([]ReportType(nil), rr.types...)
+}
+
+// Lookup finds report type by name
+func (rr *ReportTypeRegistry) Lookup(name string) (ReportType, bool) {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	for _, t := range rr.types {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return ReportType{}, false
+}
+
+// LookupReportingAPIType finds report type by W3C Reporting API entry type
+func (rr *ReportTypeRegistry) LookupReportingAPIType(reportingAPIType string) (ReportType, bool) {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	for _, t := range rr.types {
+		if t.ReportingAPIType != "" && t.ReportingAPIType == reportingAPIType {
+			return t, true
+		}
+	}
+	return ReportType{}, false
+}
+
+// DefaultRegistry contains built-in report types and is used unless another registry is configured
+var DefaultRegistry = &ReportTypeRegistry{}
+
+// RegisterReportType adds a report type to DefaultRegistry, it panics on error and is meant to be called from init()
+func RegisterReportType(reportType ReportType) {
+	if err := DefaultRegistry.Register(reportType); err != nil {
+		panic(err)
+	}
+}
+
+func init() {
+	RegisterReportType(ReportType{
+		Name:              "reporting",
+		Paths:             []string{"reporting", "nel"},
+		ContentTypes:      []string{"application/reports+json"},
+		ReportingAPIBatch: true,
+	})
+	RegisterReportType(ReportType{
+		Name:         "csp",
+		Paths:        []string{"csp"},
+		CompatPaths:  []string{"csp"},
+		ContentTypes: []string{"application/csp-report"},
+		New:          func() Reportable { return &CSPReport{} },
+		PostProcessors: []PostProcessor{
+			func(report Reportable) {
+				report.(*CSPReport).Normalize()
+			},
+		},
+	})
+	RegisterReportType(ReportType{
+		Name:        "pkp",
+		Paths:       []string{"pkp"},
+		CompatPaths: []string{"pkp"},
+		New:         func() Reportable { return &PKPReport{} },
+	})
+	RegisterReportType(ReportType{
+		Name:         "expectct",
+		Paths:        []string{"expect-ct", "expectct"},
+		CompatPaths:  []string{"expect-ct", "expectct"},
+		ContentTypes: []string{"application/expect-ct-report+json"},
+		New:          func() Reportable { return &ExpectCTReport{} },
+	})
+	RegisterReportType(ReportType{
+		Name:        "stacktracejs",
+		Paths:       []string{"stacktracejs"},
+		CompatPaths: []string{"stacktracejs"},
+		Batchable:   true,
+		New:         func() Reportable { return &StacktraceJSReport{} },
+		PostProcessors: []PostProcessor{
+			func(report Reportable) {
+				stacktraceJSReport := report.(*StacktraceJSReport)
+				stacktraceJSReport.Fingerprint = StacktraceJSFingerprint(stacktraceJSReport)
+			},
+		},
+	})
+
+	RegisterReportType(ReportType{
+		Name:             "csp-violation",
+		ReportingAPIType: "csp-violation",
+		New:              func() Reportable { return &CSPViolationReport{} },
+	})
+	RegisterReportType(ReportType{
+		Name:             "deprecation",
+		ReportingAPIType: "deprecation",
+		New:              func() Reportable { return &DeprecationReport{} },
+	})
+	RegisterReportType(ReportType{
+		Name:             "intervention",
+		ReportingAPIType: "intervention",
+		New:              func() Reportable { return &InterventionReport{} },
+	})
+	RegisterReportType(ReportType{
+		Name:             "crash",
+		ReportingAPIType: "crash",
+		New:              func() Reportable { return &CrashReport{} },
+	})
+	RegisterReportType(ReportType{
+		Name:             "nel",
+		ReportingAPIType: "network-error",
+		New:              func() Reportable { return &NELReport{} },
+	})
+	RegisterReportType(ReportType{
+		Name:             "coep",
+		ReportingAPIType: "coep",
+		New:              func() Reportable { return &COEPReport{} },
+	})
+	RegisterReportType(ReportType{
+		Name:             "coop",
+		ReportingAPIType: "coop",
+		New:              func() Reportable { return &COOPReport{} },
+	})
+}
@@ -0,0 +1,61 @@
+package frontreport
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// TestReportTypeRegistry tests that report types clashing with registered ones are rejected
+func TestReportTypeRegistry(t *testing.T) {
+	Convey("Given registry with a report type", t, func() {
+		registry := &ReportTypeRegistry{}
+		So(registry.Register(ReportType{
+			Name:             "csp",
+			Paths:            []string{"csp"},
+			CompatPaths:      []string{"csp"},
+			ContentTypes:     []string{"application/csp-report"},
+			ReportingAPIType: "csp-violation",
+			New:              func() Reportable { return &CSPReport{} },
+		}), ShouldBeNil)
+
+		for name, reportType := range map[string]ReportType{
+			"without name":                            {New: func() Reportable { return &PKPReport{} }},
+			"without constructor":                     {Name: "pkp"},
+			"constructing reports of another type":    {Name: "hpkp", New: func() Reportable { return &PKPReport{} }},
+			"with duplicate name":                     {Name: "csp", New: func() Reportable { return &CSPReport{} }},
+			"with duplicate path":                     {Name: "pkp", Paths: []string{"pkp", "csp"}, New: func() Reportable { return &PKPReport{} }},
+			"with duplicate compatibility path":       {Name: "pkp", CompatPaths: []string{"csp"}, New: func() Reportable { return &PKPReport{} }},
+			"with duplicate content type":             {Name: "pkp", ContentTypes: []string{"application/csp-report"}, New: func() Reportable { return &PKPReport{} }},
+			"with duplicate Reporting API type":       {Name: "pkp", ReportingAPIType: "csp-violation", New: func() Reportable { return &PKPReport{} }},
+			"batch with duplicate path":               {Name: "reporting", Paths: []string{"csp"}, ReportingAPIBatch: true},
+			"batch with duplicate content type":       {Name: "reporting", ContentTypes: []string{"application/csp-report"}, ReportingAPIBatch: true},
+			"batch with duplicate compatibility path": {Name: "reporting", CompatPaths: []string{"csp"}, ReportingAPIBatch: true},
+		} {
+			Convey("Report type "+name+" is rejected", func() {
+				So(registry.Register(reportType), ShouldNotBeNil)
+				So(registry.Types(), ShouldHaveLength, 1)
+			})
+		}
+
+		Convey("Report type not clashing with registered ones is added", func() {
+			So(registry.Register(ReportType{Name: "pkp", Paths: []string{"pkp"}, New: func() Reportable { return &PKPReport{} }}), ShouldBeNil)
+			So(registry.Register(ReportType{Name: "reporting", Paths: []string{"reporting"}, ReportingAPIBatch: true}), ShouldBeNil)
+			So(registry.Types(), ShouldHaveLength, 3)
+
+			reportType, found := registry.Lookup("pkp")
+			So(found, ShouldBeTrue)
+			So(reportType.Paths, ShouldResemble, []string{"pkp"})
+			reportType, found = registry.LookupReportingAPIType("csp-violation")
+			So(found, ShouldBeTrue)
+			So(reportType.Name, ShouldEqual, "csp")
+		})
+	})
+
+	Convey("Built-in report types do not clash", t, func() {
+		registry := &ReportTypeRegistry{}
+		for _, reportType := range DefaultRegistry.Types() {
+			So(registry.Register(reportType), ShouldBeNil)
+		}
+	})
+}
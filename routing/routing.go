@@ -0,0 +1,137 @@
+package routing
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// Route sends reports matching all its conditions to Storage, an empty condition matches any report;
+// hosts are shell patterns like *.example.com
+type Route struct {
+	Types    []string
+	Services []string
+	Hosts    []string
+	Storage  string
+}
+
+// ParseRoute parses route as space-separated conditions with comma-separated values and storage name,
+// e.g. "type=csp,pkp host=*.example.com storage=security"
+func ParseRoute(s string) (Route, error) {
+	var route Route
+	for _, part := range strings.Fields(s) {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return Route{}, fmt.Errorf("invalid condition %q in route %q, must be field=value", part, s)
+		}
+		values := strings.Split(strings.ToLower(kv[1]), ",")
+		switch kv[0] {
+		case "type":
+			route.Types = values
+		case "service":
+			route.Services = values
+		case "host":
+			for _, host := range values {
+				if _, err := path.Match(host, ""); err != nil {
+					return Route{}, fmt.Errorf("invalid host pattern %q in route %q", host, s)
+				}
+			}
+			route.Hosts = values
+		case "storage":
+			route.Storage = kv[1]
+		default:
+			return Route{}, fmt.Errorf("unknown field %q in route %q, must be type, service, host or storage", kv[0], s)
+		}
+	}
+	if route.Storage == "" {
+		return Route{}, fmt.Errorf("no storage in route %q", s)
+	}
+	return route, nil
+}
+
+// Match tells if report matches route conditions
+func (r Route) Match(report frontreport.Reportable) bool {
+	if len(r.Types) > 0 && !contains(r.Types, report.GetType()) {
+		return false
+	}
+	if len(r.Services) > 0 && !contains(r.Services, report.GetService()) {
+		return false
+	}
+	if len(r.Hosts) > 0 {
+		host, _ := frontreport.ReportField(report, "frontreport-host")
+		host = strings.ToLower(host)
+		for _, pattern := range r.Hosts {
+			if matched, _ := path.Match(pattern, host); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ReportStorage sends every report to the storage of the first matching route,
+// reports matching no route go to DefaultStorage
+type ReportStorage struct {
+	Routes         []Route
+	Storages       map[string]frontreport.ReportStorage
+	DefaultStorage string
+	Logger         frontreport.Logger
+	MetricStorage  frontreport.MetricStorage
+	metrics        struct {
+		routes       []frontreport.MetricCounter
+		defaultRoute frontreport.MetricCounter
+	}
+}
+
+// Start checks that all routes lead to known storages and initializes metrics
+func (rs *ReportStorage) Start() error {
+	if _, found := rs.Storages[rs.DefaultStorage]; !found {
+		return fmt.Errorf("unknown default storage %s", rs.DefaultStorage)
+	}
+	for i, route := range rs.Routes {
+		if _, found := rs.Storages[route.Storage]; !found {
+			return fmt.Errorf("unknown storage %s in route %d", route.Storage, i)
+		}
+		rs.metrics.routes = append(rs.metrics.routes, rs.MetricStorage.RegisterCounter(fmt.Sprintf("routing.route_%d.%s.reports", i, route.Storage)))
+	}
+	rs.metrics.defaultRoute = rs.MetricStorage.RegisterCounter(fmt.Sprintf("routing.default.%s.reports", rs.DefaultStorage))
+	return nil
+}
+
+// Stop does nothing
+func (rs *ReportStorage) Stop() error {
+	return nil
+}
+
+// AddReport sends a report to the storage of its route
+func (rs *ReportStorage) AddReport(report frontreport.Reportable) {
+	rs.addReport(report, true)
+}
+
+// TryAddReport is AddReport which returns false instead of blocking when the storage of the route is saturated
+func (rs *ReportStorage) TryAddReport(report frontreport.Reportable) bool {
+	return rs.addReport(report, false)
+}
+
+func (rs *ReportStorage) addReport(report frontreport.Reportable, block bool) bool {
+	for i, route := range rs.Routes {
+		if route.Match(report) {
+			rs.metrics.routes[i].Inc(1)
+			return frontreport.PassReport(rs.Storages[route.Storage], report, block)
+		}
+	}
+	rs.metrics.defaultRoute.Inc(1)
+	return frontreport.PassReport(rs.Storages[rs.DefaultStorage], report, block)
+}
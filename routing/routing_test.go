@@ -0,0 +1,57 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// TestReportStorage tests that reports go to storage of the first matching route
+func TestReportStorage(t *testing.T) {
+	Convey("Given routes for security and product reports", t, func() {
+		security, err := ParseRoute("type=csp,pkp storage=security")
+		So(err, ShouldBeNil)
+		billing, err := ParseRoute("type=stacktracejs service=billing host=*.example.com storage=billing")
+		So(err, ShouldBeNil)
+
+		storages := map[string]*frontreporttest.MemoryStorage{"security": {}, "billing": {}, "product": {}}
+		metricStorage := frontreporttest.NewMetricStorage()
+		rs := &ReportStorage{
+			Routes:         []Route{security, billing},
+			Storages:       map[string]frontreport.ReportStorage{},
+			DefaultStorage: "product",
+			Logger:         log.NewNopLogger(),
+			MetricStorage:  metricStorage,
+		}
+		for name, storage := range storages {
+			rs.Storages[name] = storage
+		}
+		So(rs.Start(), ShouldBeNil)
+
+		rs.AddReport(&frontreport.CSPReport{})
+		rs.AddReport(&frontreport.PKPReport{})
+		billingReport := &frontreport.StacktraceJSReport{}
+		billingReport.Service = "Billing"
+		billingReport.Host = "pay.example.com"
+		rs.AddReport(billingReport)
+		otherHostReport := &frontreport.StacktraceJSReport{}
+		otherHostReport.Service = "billing"
+		otherHostReport.Host = "example.org"
+		rs.AddReport(otherHostReport)
+
+		So(storages["security"].Reports(), ShouldHaveLength, 2)
+		So(storages["billing"].Reports(), ShouldResemble, []frontreport.Reportable{billingReport})
+		So(storages["product"].Reports(), ShouldResemble, []frontreport.Reportable{otherHostReport})
+	})
+
+	Convey("Invalid routes", t, func() {
+		for _, s := range []string{"type=csp", "type= storage=x", "url=x storage=x", "host=[ storage=x"} {
+			_, err := ParseRoute(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package sampling
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skbkontur/frontreport"
+)
+
+// Rule keeps reports matching all its conditions with Rate probability
+type Rule struct {
+	Conditions []Condition
+	Rate       float64
+}
+
+// Condition matches reports with a field equal to Value, Value ending with * matches by prefix;
+// "type" and "service" fields are report type and service, other fields are looked up by JSON name
+type Condition struct {
+	Field string
+	Value string
+}
+
+// ParseRule parses rule as space-separated field=value conditions and rate=probability,
+// e.g. "service=billing type=csp rate=0.05"
+func ParseRule(s string) (Rule, error) {
+	var rule Rule
+	rateFound := false
+	for _, part := range strings.Fields(s) {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return Rule{}, fmt.Errorf("invalid condition %q in sampling rule %q, must be field=value", part, s)
+		}
+		if kv[0] == "rate" {
+			rate, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return Rule{}, fmt.Errorf("invalid rate in sampling rule %q, must be between 0 and 1", s)
+			}
+			rule.Rate = rate
+			rateFound = true
+			continue
+		}
+		value := kv[1]
+		if kv[0] == "service" || kv[0] == "type" {
+			value = strings.ToLower(value)
+		}
+		rule.Conditions = append(rule.Conditions, Condition{Field: kv[0], Value: value})
+	}
+	if !rateFound {
+		return Rule{}, fmt.Errorf("no rate in sampling rule %q", s)
+	}
+	return rule, nil
+}
+
+// Match tells if report matches all rule conditions
+func (r Rule) Match(report frontreport.Reportable) bool {
+	for _, condition := range r.Conditions {
+		if !condition.Match(report) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match tells if report field matches condition value
+func (c Condition) Match(report frontreport.Reportable) bool {
+	var value string
+	switch c.Field {
+	case "type":
+		value = report.GetType()
+	case "service":
+		value = report.GetService()
+	default:
+		var found bool
+		if value, found = frontreport.ReportField(report, c.Field); !found {
+			return false
+		}
+	}
+	if strings.HasSuffix(c.Value, "*") {
+		return strings.HasPrefix(value, strings.TrimSuffix(c.Value, "*"))
+	}
+	return value == c.Value
+}
+
+// ReportStorage passes reports to the underlying ReportStorage with probability of the first matching rule
+// and records it in the report; reports matching no rule are all passed
+type ReportStorage struct {
+	ReportStorage frontreport.ReportStorage
+	Rules         []Rule
+	Logger        frontreport.Logger
+	MetricStorage frontreport.MetricStorage
+	mu            sync.Mutex
+	rand          *rand.Rand
+	metrics       struct {
+		kept        frontreport.MetricCounter
+		dropped     frontreport.MetricCounter
+		ruleKept    []frontreport.MetricCounter
+		ruleDropped []frontreport.MetricCounter
+	}
+}
+
+// Start initializes metrics and random numbers generator
+func (rs *ReportStorage) Start() error {
+	rs.metrics.kept = rs.MetricStorage.RegisterCounter("sampling.kept")
+	rs.metrics.dropped = rs.MetricStorage.RegisterCounter("sampling.dropped")
+	for i := range rs.Rules {
+		rs.metrics.ruleKept = append(rs.metrics.ruleKept, rs.MetricStorage.RegisterCounter(fmt.Sprintf("sampling.rule_%d.kept", i)))
+		rs.metrics.ruleDropped = append(rs.metrics.ruleDropped, rs.MetricStorage.RegisterCounter(fmt.Sprintf("sampling.rule_%d.dropped", i)))
+	}
+
+	rs.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return nil
+}
+
+// Stop does nothing
+func (rs *ReportStorage) Stop() error {
+	return nil
+}
+
+// AddReport passes or drops a report according to the first matching rule
+func (rs *ReportStorage) AddReport(report frontreport.Reportable) {
+	rs.addReport(report, true)
+}
+
+// TryAddReport is AddReport which returns false instead of blocking when the underlying storage is saturated,
+// dropped reports count as accepted
+func (rs *ReportStorage) TryAddReport(report frontreport.Reportable) bool {
+	return rs.addReport(report, false)
+}
+
+func (rs *ReportStorage) addReport(report frontreport.Reportable, block bool) bool {
+	for i, rule := range rs.Rules {
+		if !rule.Match(report) {
+			continue
+		}
+		if !rs.sample(rule.Rate) {
+			rs.metrics.dropped.Inc(1)
+			rs.metrics.ruleDropped[i].Inc(1)
+			return true
+		}
+		if sampledReport, ok := report.(frontreport.SampledReport); ok {
+			sampledReport.SetSampleRate(rule.Rate)
+		}
+		rs.metrics.kept.Inc(1)
+		rs.metrics.ruleKept[i].Inc(1)
+		return frontreport.PassReport(rs.ReportStorage, report, block)
+	}
+	rs.metrics.kept.Inc(1)
+	return frontreport.PassReport(rs.ReportStorage, report, block)
+}
+
+func (rs *ReportStorage) sample(rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.rand.Float64() < rate
+}
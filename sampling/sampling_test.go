@@ -0,0 +1,66 @@
+package sampling
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+func cspReport(service, violatedDirective string) *frontreport.CSPReport {
+	report := &frontreport.CSPReport{}
+	report.Service = service
+	report.Body.ViolatedDirective = violatedDirective
+	return report
+}
+
+// TestParseRule tests sampling rules syntax
+func TestParseRule(t *testing.T) {
+	Convey("Valid rules", t, func() {
+		rule, err := ParseRule("service=Billing type=csp rate=0.05")
+		So(err, ShouldBeNil)
+		So(rule.Rate, ShouldEqual, 0.05)
+		So(rule.Conditions, ShouldResemble, []Condition{{"service", "billing"}, {"type", "csp"}})
+
+		rule, err = ParseRule(" violated-directive=img-src  rate=0.01 ")
+		So(err, ShouldBeNil)
+		So(rule.Conditions, ShouldResemble, []Condition{{"violated-directive", "img-src"}})
+	})
+
+	Convey("Invalid rules", t, func() {
+		for _, s := range []string{"service=billing", "rate=1.5", "rate=x", "service rate=0.1", "=x rate=0.1"} {
+			_, err := ParseRule(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+// TestReportStorage tests that the first matching rule decides whether a report is stored
+func TestReportStorage(t *testing.T) {
+	Convey("Given sampling storage", t, func() {
+		next := &frontreporttest.MemoryStorage{}
+		metricStorage := frontreporttest.NewMetricStorage()
+		rs := &ReportStorage{
+			ReportStorage: next,
+			Rules: []Rule{
+				{Conditions: []Condition{{"violated-directive", "img-src*"}}, Rate: 0},
+				{Conditions: []Condition{{"service", "billing"}, {"type", "csp"}}, Rate: 1},
+			},
+			Logger:        log.NewNopLogger(),
+			MetricStorage: metricStorage,
+		}
+		So(rs.Start(), ShouldBeNil)
+
+		rs.AddReport(cspReport("billing", "img-src 'self'"))
+		rs.AddReport(cspReport("billing", "script-src"))
+		rs.AddReport(cspReport("shop", "script-src"))
+		rs.AddReport(&frontreport.StacktraceJSReport{})
+
+		So(next.Reports(), ShouldHaveLength, 3)
+		So(next.Reports()[0].(*frontreport.CSPReport).SampleRate, ShouldEqual, 1)
+		So(next.Reports()[1].(*frontreport.CSPReport).SampleRate, ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,653 @@
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+
+	"github.com/skbkontur/frontreport"
+)
+
+const (
+	segmentSuffix = ".spool"
+	positionFile  = "position"
+	// positionSaveInterval is how many sent reports may be sent again after a crash
+	positionSaveInterval = 100
+)
+
+// Backend is a storage behind a spool, the spool starts and stops it, so that reports it fails
+// to send while stopping are spooled, and sends spooled reports to it in batches
+type Backend interface {
+	frontreport.ReportStorage
+	frontreport.ReportSender
+	frontreport.Service
+}
+
+// ReportStorage is a write-ahead spool in front of a Backend: reports go to the backend as long as it takes them,
+// reports it refuses as its queue is full or fails to send after all retries are appended to segment files in Dir
+// and sent again in batches of BatchSize, a batch which failed to send is retried every RetryInterval,
+// so reports survive backend outages and restarts; when spool exceeds MaxBytes or segments get older
+// than MaxAge, the oldest segments are dropped; Name tells apart metrics of several spools
+type ReportStorage struct {
+	Name          string
+	Dir           string
+	SegmentSize   int64
+	MaxBytes      int64
+	MaxAge        time.Duration
+	BatchSize     int
+	RetryInterval time.Duration
+	Backend       Backend
+	Logger        frontreport.Logger
+	MetricStorage frontreport.MetricStorage
+	mu            sync.Mutex
+	segments      []*segment
+	nextSeq       uint64
+	writer        *os.File
+	reader        *os.File
+	readerSeq     uint64
+	readOffset    int64
+	unsaved       int64
+	wake          chan struct{}
+	tomb          tomb.Tomb
+	metrics       struct {
+		depth        frontreport.MetricGauge
+		bytes        frontreport.MetricGauge
+		dropped      frontreport.MetricCounter
+		sendErrors   frontreport.MetricCounter
+		decodeErrors frontreport.MetricCounter
+		writeErrors  frontreport.MetricCounter
+	}
+}
+
+// segment is a spool file, reports are read from the first segment and written to the last one
+type segment struct {
+	seq       uint64
+	size      int64
+	reports   int64
+	lastWrite time.Time
+}
+
+// record is a line of a segment file, Time is when the report was received,
+// so that it is sent to the index of that day however late it is sent
+type record struct {
+	Type    string          `json:"type"`
+	Service string          `json:"service,omitempty"`
+	Host    string          `json:"host,omitempty"`
+	Time    time.Time       `json:"time"`
+	Report  json.RawMessage `json:"report"`
+}
+
+// Start loads spooled reports left from previous run, starts the backend and starts sending spooled reports
+func (rs *ReportStorage) Start() error {
+	if rs.SegmentSize <= 0 {
+		return errors.New("spool segment size must be positive")
+	}
+	if rs.MaxBytes > 0 && rs.MaxBytes < rs.SegmentSize {
+		return fmt.Errorf("spool size limit %d is less than segment size %d", rs.MaxBytes, rs.SegmentSize)
+	}
+	if rs.BatchSize <= 0 {
+		return errors.New("spool batch size must be positive")
+	}
+
+	prefix := "spool."
+	if rs.Name != "" {
+		prefix += rs.Name + "."
+	}
+	rs.metrics.depth = rs.MetricStorage.RegisterGauge(prefix + "depth")
+	rs.metrics.bytes = rs.MetricStorage.RegisterGauge(prefix + "bytes")
+	rs.metrics.dropped = rs.MetricStorage.RegisterCounter(prefix + "dropped")
+	rs.metrics.sendErrors = rs.MetricStorage.RegisterCounter(prefix + "send.errors")
+	rs.metrics.decodeErrors = rs.MetricStorage.RegisterCounter(prefix + "decode.errors")
+	rs.metrics.writeErrors = rs.MetricStorage.RegisterCounter(prefix + "write.errors")
+
+	if err := os.MkdirAll(rs.Dir, 0755); err != nil {
+		return err
+	}
+	if err := rs.load(); err != nil {
+		return err
+	}
+	if depth := rs.depth(); depth > 0 {
+		rs.Logger.Log("msg", "loaded spooled reports", "dir", rs.Dir, "count", depth)
+	}
+	rs.updateMetrics()
+
+	rs.wake = make(chan struct{}, 1)
+	if err := rs.Backend.Start(); err != nil {
+		return err
+	}
+	rs.tomb.Go(rs.send)
+	if rs.MaxAge > 0 {
+		rs.tomb.Go(rs.expire)
+	}
+	return nil
+}
+
+// Stop stops sending spooled reports and stops the backend, reports it fails to flush are spooled;
+// unsent reports are sent after restart
+func (rs *ReportStorage) Stop() error {
+	rs.tomb.Kill(nil)
+	err := rs.tomb.Wait()
+	if stopErr := rs.Backend.Stop(); stopErr != nil && err == nil {
+		err = stopErr
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.writer != nil {
+		rs.writer.Close()
+		rs.writer = nil
+	}
+	if rs.reader != nil {
+		rs.reader.Close()
+		rs.reader = nil
+	}
+	if saveErr := rs.savePosition(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// AddReport is TryAddReport, as spooling never blocks
+func (rs *ReportStorage) AddReport(report frontreport.Reportable) {
+	rs.TryAddReport(report)
+}
+
+// TryAddReport passes a report to the backend and spools it if the backend queue is full or there are spooled reports,
+// so that reports are sent in order; it returns false only if the report could not be spooled
+func (rs *ReportStorage) TryAddReport(report frontreport.Reportable) bool {
+	rs.mu.Lock()
+	spooling := rs.depth() > 0
+	rs.mu.Unlock()
+	if !spooling && frontreport.PassReport(rs.Backend, report, false) {
+		return true
+	}
+	return rs.spool([]frontreport.Reportable{report})
+}
+
+// AddFailedReports spools reports the backend failed to send after all retries
+func (rs *ReportStorage) AddFailedReports(reports []frontreport.Reportable) {
+	rs.spool(reports)
+}
+
+// spool appends reports to the spool and tells if they have been written
+func (rs *ReportStorage) spool(reports []frontreport.Reportable) bool {
+	var lines [][]byte
+	for _, report := range reports {
+		line, err := encode(report)
+		if err != nil {
+			rs.Logger.Log("msg", "failed to encode", "report_type", report.GetType(), "error", err)
+			rs.metrics.writeErrors.Inc(1)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return true
+	}
+
+	rs.mu.Lock()
+	err := rs.write(lines)
+	if err == nil {
+		for rs.MaxBytes > 0 && rs.size() > rs.MaxBytes && len(rs.segments) > 1 {
+			rs.drop("spool is full")
+		}
+	}
+	rs.updateMetrics()
+	rs.mu.Unlock()
+
+	if err != nil {
+		rs.Logger.Log("msg", "failed to spool reports", "count", len(lines), "error", err)
+		rs.metrics.writeErrors.Inc(int64(len(lines)))
+		return false
+	}
+	select {
+	case rs.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// encode makes a segment file line of a report
+func encode(report frontreport.Reportable) ([]byte, error) {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	r := record{Type: report.GetType(), Service: report.GetService(), Time: receivedAt(report, reportJSON), Report: reportJSON}
+	if hostReport, ok := report.(frontreport.HostReport); ok {
+		r.Host = hostReport.GetHost()
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// receivedAt tells when a report was received by its timestamp, a report without one is considered just received
+func receivedAt(report frontreport.Reportable, reportJSON []byte) time.Time {
+	if _, ok := report.(*frontreport.RawReport); ok {
+		return frontreport.ReceivedAt(report)
+	}
+	var timestamped struct {
+		Timestamp string `json:"@timestamp"`
+	}
+	if err := json.Unmarshal(reportJSON, &timestamped); err == nil {
+		if t, err := time.Parse(frontreport.TimestampFormat, timestamped.Timestamp); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+// write appends lines to the last segment, starting a new one when it is full, and syncs it to disk
+func (rs *ReportStorage) write(lines [][]byte) error {
+	for _, line := range lines {
+		last := rs.last()
+		if rs.writer == nil || (last.size > 0 && last.size+int64(len(line)) > rs.SegmentSize) {
+			if err := rs.rotate(); err != nil {
+				return err
+			}
+			last = rs.last()
+		}
+
+		n, err := rs.writer.Write(line)
+		last.size += int64(n)
+		last.lastWrite = time.Now()
+		if err != nil {
+			// a partially written line is skipped as undecodable when read, new lines go to a new segment
+			rs.writer.Close()
+			rs.writer = nil
+			return err
+		}
+		last.reports++
+	}
+
+	if err := rs.writer.Sync(); err != nil {
+		rs.writer.Close()
+		rs.writer = nil
+		return err
+	}
+	return nil
+}
+
+// rotate closes the last segment for writing and starts a new one
+func (rs *ReportStorage) rotate() error {
+	if rs.writer != nil {
+		err := rs.writer.Sync()
+		rs.writer.Close()
+		rs.writer = nil
+		if err != nil {
+			return err
+		}
+	}
+	seg := &segment{seq: rs.nextSeq, lastWrite: time.Now()}
+	f, err := os.OpenFile(rs.segmentPath(seg.seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	rs.nextSeq++
+	rs.writer = f
+	rs.segments = append(rs.segments, seg)
+	// reports synced to the new segment are lost in a crash unless its directory entry is synced too
+	return syncDir(rs.Dir)
+}
+
+// drop removes the oldest segment with all its unsent reports
+func (rs *ReportStorage) drop(reason string) {
+	seg := rs.segments[0]
+	reports := seg.reports
+	if rs.writer != nil && len(rs.segments) == 1 {
+		rs.writer.Close()
+		rs.writer = nil
+	}
+	rs.remove()
+	rs.Logger.Log("msg", "dropped spooled reports", "reason", reason, "count", reports)
+	rs.metrics.dropped.Inc(reports)
+}
+
+// remove deletes the first segment and moves read position to the next one
+func (rs *ReportStorage) remove() {
+	seg := rs.segments[0]
+	if rs.reader != nil && rs.readerSeq == seg.seq {
+		rs.reader.Close()
+		rs.reader = nil
+	}
+	if err := os.Remove(rs.segmentPath(seg.seq)); err != nil && !os.IsNotExist(err) {
+		rs.Logger.Log("msg", "failed to remove spool segment", "seq", seg.seq, "error", err)
+	}
+	rs.segments = rs.segments[1:]
+	rs.readOffset = 0
+	if err := rs.savePosition(); err != nil {
+		rs.Logger.Log("msg", "failed to save spool position", "error", err)
+	}
+}
+
+// send passes spooled reports to the backend in batches, a batch which failed to send is retried after RetryInterval,
+// reports of a partially sent batch which are worth retrying are spooled again
+func (rs *ReportStorage) send() error {
+	for {
+		reports, seq, offset, lines := rs.next(rs.BatchSize)
+		if lines == 0 {
+			select {
+			case <-rs.tomb.Dying():
+				return nil
+			case <-rs.wake:
+			}
+			continue
+		}
+
+		var retry []frontreport.Reportable
+		if len(reports) > 0 {
+			var err error
+			retry, err = rs.Backend.SendReports(reports)
+			if err != nil {
+				rs.Logger.Log("msg", "failed to send spooled reports", "count", len(reports), "failed", len(retry), "error", err)
+				rs.metrics.sendErrors.Inc(1)
+			}
+		}
+
+		if len(retry) < len(reports) || len(reports) == 0 {
+			rs.mu.Lock()
+			rs.advance(seq, offset, lines)
+			rs.updateMetrics()
+			rs.mu.Unlock()
+			if len(retry) > 0 {
+				rs.spool(retry)
+			}
+		}
+		if len(retry) > 0 {
+			select {
+			case <-rs.tomb.Dying():
+				return nil
+			case <-time.After(rs.RetryInterval):
+			}
+		}
+	}
+}
+
+// next reads up to max reports at read position of the first segment, it skips undecodable lines and deletes
+// fully read segments; it returns the reports, their segment, offset past them and the number of lines read
+func (rs *ReportStorage) next(max int) ([]frontreport.Reportable, uint64, int64, int64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for len(rs.segments) > 0 {
+		seg := rs.segments[0]
+		if rs.readOffset >= seg.size {
+			if len(rs.segments) == 1 {
+				// the only segment may still be written to
+				return nil, 0, 0, 0
+			}
+			rs.remove()
+			continue
+		}
+
+		lines, err := rs.readLines(seg, max)
+		if err != nil {
+			rs.Logger.Log("msg", "failed to read spool segment", "seq", seg.seq, "error", err)
+			rs.metrics.decodeErrors.Inc(1)
+			rs.drop("unreadable segment")
+			continue
+		}
+
+		var reports []frontreport.Reportable
+		offset := rs.readOffset
+		for _, line := range lines {
+			var r record
+			if err := json.Unmarshal(line, &r); err != nil {
+				rs.Logger.Log("msg", "failed to decode spooled report", "seq", seg.seq, "offset", offset, "error", err)
+				rs.metrics.decodeErrors.Inc(1)
+			} else {
+				reports = append(reports, &frontreport.RawReport{Type: r.Type, Service: r.Service, Host: r.Host, JSON: r.Report, Time: r.Time})
+			}
+			offset += int64(len(line))
+		}
+		return reports, seg.seq, offset, int64(len(lines))
+	}
+	return nil, 0, 0, 0
+}
+
+// readLines reads up to max lines at read position of the first segment, the last line may lack newline if its write failed
+func (rs *ReportStorage) readLines(seg *segment, max int) ([][]byte, error) {
+	if rs.reader == nil || rs.readerSeq != seg.seq {
+		if rs.reader != nil {
+			rs.reader.Close()
+		}
+		f, err := os.Open(rs.segmentPath(seg.seq))
+		if err != nil {
+			rs.reader = nil
+			return nil, err
+		}
+		rs.reader, rs.readerSeq = f, seg.seq
+	}
+
+	var lines [][]byte
+	reader := bufio.NewReader(io.NewSectionReader(rs.reader, rs.readOffset, seg.size-rs.readOffset))
+	for len(lines) < max {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+// advance moves read position past sent lines unless their segment has been dropped meanwhile
+func (rs *ReportStorage) advance(seq uint64, offset int64, lines int64) {
+	if len(rs.segments) == 0 || rs.segments[0].seq != seq {
+		return
+	}
+	rs.readOffset = offset
+	rs.segments[0].reports -= lines
+	rs.unsaved += lines
+	if rs.unsaved >= positionSaveInterval {
+		if err := rs.savePosition(); err != nil {
+			rs.Logger.Log("msg", "failed to save spool position", "error", err)
+		}
+	}
+}
+
+// expire drops segments with all reports older than MaxAge
+func (rs *ReportStorage) expire() error {
+	ticker := time.NewTicker(rs.MaxAge / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.tomb.Dying():
+			return nil
+		case now := <-ticker.C:
+			rs.mu.Lock()
+			for len(rs.segments) > 0 && now.Sub(rs.segments[0].lastWrite) > rs.MaxAge {
+				rs.drop("reports are too old")
+			}
+			rs.updateMetrics()
+			rs.mu.Unlock()
+		}
+	}
+}
+
+// load finds segments and read position left from previous run, new reports always go to a new segment
+func (rs *ReportStorage) load() error {
+	files, err := ioutil.ReadDir(rs.Dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		rs.segments = append(rs.segments, &segment{seq: seq, size: file.Size(), lastWrite: file.ModTime()})
+	}
+	sort.Slice(rs.segments, func(i, j int) bool { return rs.segments[i].seq < rs.segments[j].seq })
+	if len(rs.segments) > 0 {
+		rs.nextSeq = rs.last().seq + 1
+	}
+
+	seq, offset, err := rs.loadPosition()
+	if err != nil {
+		return err
+	}
+	for len(rs.segments) > 0 && rs.segments[0].seq < seq {
+		// segment has been sent, but not deleted
+		if err := os.Remove(rs.segmentPath(rs.segments[0].seq)); err != nil {
+			return err
+		}
+		rs.segments = rs.segments[1:]
+	}
+	if len(rs.segments) > 0 && rs.segments[0].seq == seq && offset <= rs.segments[0].size {
+		rs.readOffset = offset
+	}
+
+	for i, seg := range rs.segments {
+		var from int64
+		if i == 0 {
+			from = rs.readOffset
+		}
+		if seg.reports, err = rs.countLines(seg, from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countLines counts lines in a segment starting from offset, including the last line without newline
+func (rs *ReportStorage) countLines(seg *segment, offset int64) (int64, error) {
+	f, err := os.Open(rs.segmentPath(seg.seq))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var count int64
+	var last byte = '\n'
+	buf := make([]byte, 64*1024)
+	r := io.NewSectionReader(f, offset, seg.size-offset)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			count += int64(bytes.Count(buf[:n], []byte{'\n'}))
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if last != '\n' {
+		count++
+	}
+	return count, nil
+}
+
+func (rs *ReportStorage) loadPosition() (uint64, int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(rs.Dir, positionFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var seq uint64
+	var offset int64
+	if _, err := fmt.Sscan(string(data), &seq, &offset); err != nil {
+		return 0, 0, fmt.Errorf("malformed spool position file: %s", err)
+	}
+	return seq, offset, nil
+}
+
+// savePosition atomically replaces position file with current read position
+func (rs *ReportStorage) savePosition() error {
+	rs.unsaved = 0
+	var seq uint64
+	if len(rs.segments) > 0 {
+		seq = rs.segments[0].seq
+	} else {
+		seq = rs.nextSeq
+	}
+	path := filepath.Join(rs.Dir, positionFile)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d\n", seq, rs.readOffset)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(rs.Dir)
+}
+
+// syncDir makes created, renamed and removed files of a directory survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (rs *ReportStorage) segmentPath(seq uint64) string {
+	return filepath.Join(rs.Dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+func (rs *ReportStorage) last() *segment {
+	if len(rs.segments) == 0 {
+		return nil
+	}
+	return rs.segments[len(rs.segments)-1]
+}
+
+func (rs *ReportStorage) size() int64 {
+	var size int64
+	for _, seg := range rs.segments {
+		size += seg.size
+	}
+	return size
+}
+
+func (rs *ReportStorage) depth() int64 {
+	var depth int64
+	for _, seg := range rs.segments {
+		depth += seg.reports
+	}
+	return depth
+}
+
+func (rs *ReportStorage) updateMetrics() {
+	rs.metrics.depth.Update(rs.depth())
+	rs.metrics.bytes.Update(rs.size())
+}
@@ -0,0 +1,313 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/skbkontur/frontreport"
+	"github.com/skbkontur/frontreport/internal/frontreporttest"
+)
+
+// flakyBackend refuses reports while it is full, fails to send them while it is down and remembers sent reports;
+// reports to fail on stop are passed to failedStorage
+type flakyBackend struct {
+	mu            sync.Mutex
+	full          bool
+	down          bool
+	retryOnce     map[string]bool
+	batches       [][]frontreport.Reportable
+	reports       []frontreport.Reportable
+	failOnStop    []frontreport.Reportable
+	failedStorage frontreport.FailedReportStorage
+	started       bool
+}
+
+func (fb *flakyBackend) Start() error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.started = true
+	return nil
+}
+
+func (fb *flakyBackend) Stop() error {
+	fb.mu.Lock()
+	failed := fb.failOnStop
+	fb.failOnStop, fb.started = nil, false
+	fb.mu.Unlock()
+	if len(failed) > 0 {
+		fb.failedStorage.AddFailedReports(failed)
+	}
+	return nil
+}
+
+func (fb *flakyBackend) AddReport(report frontreport.Reportable) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.reports = append(fb.reports, report)
+}
+
+func (fb *flakyBackend) TryAddReport(report frontreport.Reportable) bool {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if fb.full {
+		return false
+	}
+	fb.reports = append(fb.reports, report)
+	return true
+}
+
+func (fb *flakyBackend) SendReports(reports []frontreport.Reportable) ([]frontreport.Reportable, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if !fb.started {
+		panic("backend is not started")
+	}
+	if fb.down {
+		return reports, errors.New("backend is down")
+	}
+	var retry []frontreport.Reportable
+	for _, report := range reports {
+		if message := message(report); fb.retryOnce[message] {
+			delete(fb.retryOnce, message)
+			retry = append(retry, report)
+			continue
+		}
+		fb.reports = append(fb.reports, report)
+	}
+	fb.batches = append(fb.batches, reports)
+	if len(retry) > 0 {
+		return retry, errors.New("backend is overloaded")
+	}
+	return nil, nil
+}
+
+func (fb *flakyBackend) set(full, down bool) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.full, fb.down = full, down
+}
+
+func (fb *flakyBackend) messages() []string {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	var messages []string
+	for _, report := range fb.reports {
+		messages = append(messages, message(report))
+	}
+	return messages
+}
+
+func message(report frontreport.Reportable) string {
+	var document struct {
+		Message string `json:"message"`
+	}
+	data, _ := json.Marshal(report)
+	json.Unmarshal(data, &document)
+	return document.Message
+}
+
+func stacktraceJSReport(message string) *frontreport.StacktraceJSReport {
+	report := &frontreport.StacktraceJSReport{Message: message}
+	report.Service = "billing"
+	return report
+}
+
+func depth(rs *ReportStorage) int64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.depth()
+}
+
+func size(rs *ReportStorage) int64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.size()
+}
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// TestReportStorage tests that reports refused by backend are spooled, sent in batches once backend recovers and survive restarts
+func TestReportStorage(t *testing.T) {
+	Convey("Given spool in an empty directory", t, func() {
+		dir, err := ioutil.TempDir("", "spool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		backend := &flakyBackend{full: true, down: true, retryOnce: make(map[string]bool)}
+		metricStorage := frontreporttest.NewMetricStorage()
+		newSpool := func() *ReportStorage {
+			rs := &ReportStorage{
+				Dir:           dir,
+				SegmentSize:   200,
+				BatchSize:     2,
+				RetryInterval: 10 * time.Millisecond,
+				Backend:       backend,
+				Logger:        log.NewNopLogger(),
+				MetricStorage: metricStorage,
+			}
+			backend.failedStorage = rs
+			return rs
+		}
+		rs := newSpool()
+		So(rs.Start(), ShouldBeNil)
+		So(backend.started, ShouldBeTrue)
+
+		Convey("Reports go to backend without spooling while it takes them", func() {
+			backend.set(false, true)
+			rs.AddReport(stacktraceJSReport("a"))
+			So(rs.TryAddReport(stacktraceJSReport("b")), ShouldBeTrue)
+			So(rs.Stop(), ShouldBeNil)
+
+			So(backend.messages(), ShouldResemble, []string{"a", "b"})
+			So(backend.batches, ShouldBeEmpty)
+			segments, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+			So(err, ShouldBeNil)
+			So(segments, ShouldBeEmpty)
+		})
+
+		Convey("Refused reports are kept while backend is down and sent in batches when it recovers", func() {
+			for _, message := range []string{"a", "b", "c", "d", "e"} {
+				So(rs.TryAddReport(stacktraceJSReport(message)), ShouldBeTrue)
+			}
+			time.Sleep(50 * time.Millisecond)
+			So(backend.messages(), ShouldBeEmpty)
+			So(depth(rs), ShouldEqual, 5)
+			So(metricStorage.Value("spool.depth"), ShouldEqual, 5)
+
+			backend.set(true, false)
+			So(waitFor(func() bool { return len(backend.messages()) == 5 }), ShouldBeTrue)
+			So(rs.Stop(), ShouldBeNil)
+
+			So(backend.messages(), ShouldResemble, []string{"a", "b", "c", "d", "e"})
+			for _, batch := range backend.batches {
+				So(len(batch), ShouldBeLessThanOrEqualTo, 2)
+			}
+			So(backend.reports[0].GetType(), ShouldEqual, "stacktracejs")
+			So(backend.reports[0].GetService(), ShouldEqual, "billing")
+			So(metricStorage.Count("spool.send.errors"), ShouldBeGreaterThan, 0)
+
+			segments, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+			So(err, ShouldBeNil)
+			So(segments, ShouldHaveLength, 1)
+		})
+
+		Convey("New reports are spooled behind spooled ones, so that they are sent in order", func() {
+			So(rs.TryAddReport(stacktraceJSReport("a")), ShouldBeTrue)
+			backend.set(false, true)
+			So(rs.TryAddReport(stacktraceJSReport("b")), ShouldBeTrue)
+			rs.AddReport(stacktraceJSReport("c"))
+			So(backend.messages(), ShouldBeEmpty)
+			So(depth(rs), ShouldEqual, 3)
+
+			backend.set(false, false)
+			So(waitFor(func() bool { return depth(rs) == 0 }), ShouldBeTrue)
+			rs.AddReport(stacktraceJSReport("d"))
+			So(rs.Stop(), ShouldBeNil)
+			So(backend.messages(), ShouldResemble, []string{"a", "b", "c", "d"})
+		})
+
+		Convey("Spooled reports keep the time they were received", func() {
+			received := stacktraceJSReport("a")
+			received.SetTimestamp("2020-02-14T10:00:00.123Z")
+			rs.AddReport(received)
+			rs.AddReport(stacktraceJSReport("b"))
+			backend.set(true, false)
+			So(waitFor(func() bool { return len(backend.messages()) == 2 }), ShouldBeTrue)
+			So(rs.Stop(), ShouldBeNil)
+
+			receivedAt := frontreport.ReceivedAt(backend.reports[0])
+			So(receivedAt.Equal(time.Date(2020, 2, 14, 10, 0, 0, 123000000, time.UTC)), ShouldBeTrue)
+			So(frontreport.ReceivedAt(backend.reports[1]), ShouldHappenWithin, time.Minute, time.Now())
+			So(backend.reports[1].(*frontreport.RawReport).Time.IsZero(), ShouldBeFalse)
+		})
+
+		Convey("Reports of a partially sent batch which are worth retrying are spooled again", func() {
+			So(rs.Stop(), ShouldBeNil)
+			rs = newSpool()
+			rs.SegmentSize = 1000
+			So(rs.Start(), ShouldBeNil)
+
+			backend.set(true, false)
+			backend.retryOnce["a"] = true
+			rs.AddFailedReports([]frontreport.Reportable{stacktraceJSReport("a"), stacktraceJSReport("b")})
+			So(waitFor(func() bool { return len(backend.messages()) == 2 }), ShouldBeTrue)
+			So(rs.Stop(), ShouldBeNil)
+
+			So(backend.messages(), ShouldResemble, []string{"b", "a"})
+			So(depth(rs), ShouldEqual, 0)
+		})
+
+		Convey("Unsent reports, including the ones backend failed to send on stop, are sent after restart", func() {
+			for _, message := range []string{"a", "b", "c"} {
+				rs.AddReport(stacktraceJSReport(message))
+			}
+			backend.failOnStop = []frontreport.Reportable{stacktraceJSReport("d")}
+			So(rs.Stop(), ShouldBeNil)
+			So(backend.started, ShouldBeFalse)
+
+			backend.set(true, false)
+			rs = newSpool()
+			So(rs.Start(), ShouldBeNil)
+			So(depth(rs), ShouldEqual, 4)
+			So(waitFor(func() bool { return len(backend.messages()) == 4 }), ShouldBeTrue)
+
+			rs.AddReport(stacktraceJSReport("e"))
+			So(waitFor(func() bool { return len(backend.messages()) == 5 }), ShouldBeTrue)
+			So(rs.Stop(), ShouldBeNil)
+
+			rs = newSpool()
+			So(rs.Start(), ShouldBeNil)
+			So(depth(rs), ShouldEqual, 0)
+			So(rs.Stop(), ShouldBeNil)
+			So(backend.messages(), ShouldResemble, []string{"a", "b", "c", "d", "e"})
+		})
+
+		Convey("The oldest segments are dropped when spool is full", func() {
+			So(rs.Stop(), ShouldBeNil)
+			rs = newSpool()
+			rs.MaxBytes = 300
+			So(rs.Start(), ShouldBeNil)
+
+			for _, message := range []string{"a", "b", "c", "d", "e", "f"} {
+				rs.AddReport(stacktraceJSReport(message))
+			}
+			So(size(rs), ShouldBeLessThanOrEqualTo, 300)
+			So(metricStorage.Count("spool.dropped"), ShouldBeGreaterThan, 0)
+
+			backend.set(true, false)
+			So(waitFor(func() bool { return depth(rs) == 0 }), ShouldBeTrue)
+			So(rs.Stop(), ShouldBeNil)
+			messages := backend.messages()
+			So(len(messages), ShouldBeLessThan, 6)
+			So(messages[len(messages)-1], ShouldEqual, "f")
+		})
+
+		Convey("Spool without segment size limit or smaller than a segment is not started", func() {
+			So(rs.Stop(), ShouldBeNil)
+			rs = newSpool()
+			rs.SegmentSize = 0
+			So(rs.Start(), ShouldNotBeNil)
+
+			rs = newSpool()
+			rs.MaxBytes = 100
+			So(rs.Start(), ShouldNotBeNil)
+		})
+	})
+}